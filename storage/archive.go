@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ArchiveVersion is the archive format written by NewArchiveWriter
+const ArchiveVersion = 1
+
+// manifestName is the first entry of every archive
+const manifestName = "manifest.json"
+
+// Manifest describes an archive: which backend wrote it and the files that follow it.
+// The files are the ones Backup writes, under the names it gives them.
+type Manifest struct {
+	Version int       `json:"version"`
+	Backend string    `json:"backend"`
+	Created time.Time `json:"created"`
+	Files   []string  `json:"files"`
+}
+
+// ArchiveWriter writes a backup archive: a tar stream with the manifest first, then the files it lists
+type ArchiveWriter struct {
+	tw *tar.Writer
+	m  *Manifest
+}
+
+// NewArchiveWriter writes the manifest to w, the files must follow through Add or AddFile
+func NewArchiveWriter(w io.Writer, backend string, files ...string) (*ArchiveWriter, error) {
+	m := &Manifest{
+		Version: ArchiveVersion,
+		Backend: backend,
+		Created: time.Now().UTC(),
+		Files:   files,
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ArchiveWriter{tw: tar.NewWriter(w), m: m}
+
+	err = a.Add(manifestName, int64(len(data)), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Add writes a file of size bytes, write must write exactly that much
+func (a *ArchiveWriter) Add(name string, size int64, write func(w io.Writer) error) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: a.m.Created,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return write(a.tw)
+}
+
+// AddFile writes a file from disk under name
+func (a *ArchiveWriter) AddFile(name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return a.Add(name, info.Size(), func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// Close ends the tar stream, it does not close the underlying writer
+func (a *ArchiveWriter) Close() error {
+	return a.tw.Close()
+}
+
+// ReadArchive extracts an archive written by ArchiveWriter into dir and returns its manifest.
+// Entries the manifest does not list are rejected, so nothing is written outside dir.
+func ReadArchive(r io.Reader, dir string) (*Manifest, error) {
+	tr := tar.NewReader(r)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+
+	if header.Name != manifestName {
+		return nil, fmt.Errorf("archive: first entry is %s, not %s", header.Name, manifestName)
+	}
+
+	m := &Manifest{}
+	err = json.NewDecoder(tr).Decode(m)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %s: %w", manifestName, err)
+	}
+
+	if m.Version != ArchiveVersion {
+		return nil, fmt.Errorf("archive: unknown version %d", m.Version)
+	}
+
+	found := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("archive: %w", err)
+		}
+
+		if !Contains(m.Files, []byte(header.Name)) || filepath.Base(header.Name) != header.Name || found[header.Name] {
+			return nil, fmt.Errorf("archive: unexpected entry %s", header.Name)
+		}
+
+		err = extract(tr, filepath.Join(dir, header.Name))
+		if err != nil {
+			return nil, fmt.Errorf("archive: %s: %w", header.Name, err)
+		}
+
+		found[header.Name] = true
+	}
+
+	for _, name := range m.Files {
+		if !found[name] {
+			return nil, fmt.Errorf("archive: missing entry %s", name)
+		}
+	}
+
+	return m, nil
+}
+
+func extract(r io.Reader, file string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
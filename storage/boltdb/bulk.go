@@ -0,0 +1,155 @@
+package boltdbstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var errLoaderClosed = errors.New("bulk loader closed")
+
+// MSet writes all items in a single transaction
+func (s *Store) MSet(bucketName []byte, items map[string][]byte) error {
+	if s.readOnly {
+		return fmt.Errorf("mset %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("mset %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	for k, v := range items {
+		if len(k) == 0 {
+			return fmt.Errorf("mset %s: %w", bucketName, storage.ErrEmptyKey)
+		}
+
+		if len(v) == 0 {
+			return fmt.Errorf("mset %s: %s: %w", bucketName, k, storage.ErrEmptyValue)
+		}
+	}
+
+	return s.mset(bucketName, items, s.update)
+}
+
+// mset puts items in key order through commit, either db.Update or db.Batch
+func (s *Store) mset(bucketName []byte, items map[string][]byte, commit func(func(*bolt.Tx) error) error) error {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// db.Batch may run this more than once, puts are idempotent
+	return commit(func(t *bolt.Tx) error {
+		b := t.Bucket(bucketName)
+
+		for _, k := range keys {
+			err := b.Put([]byte(k), items[k])
+			if err != nil {
+				return err
+			}
+
+			err = storage.SetValue(t, bucketName, []byte(k), items[k])
+			if err != nil {
+				return err
+			}
+
+			err = storage.LogChange(t, bucketName, []byte(k))
+			if err != nil {
+				return err
+			}
+
+			err = setExpiry(t, bucketName, []byte(k), 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// BulkLoader returns a loader committing every size items through db.Batch,
+// so loaders running in separate goroutines share transactions too.
+func (s *Store) BulkLoader(bucketName []byte, size int) (interfaces.BulkLoader, error) {
+	if s.readOnly {
+		return nil, fmt.Errorf("bulkloader %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("bulkloader %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &bulkLoader{
+		s:          s,
+		bucketName: bucketName,
+		size:       size,
+		items:      make(map[string][]byte, size),
+	}, nil
+}
+
+type bulkLoader struct {
+	s          *Store
+	bucketName []byte
+	size       int
+	items      map[string][]byte
+	closed     bool
+}
+
+func (l *bulkLoader) Add(k []byte, v []byte) error {
+	if l.closed {
+		return fmt.Errorf("add %s: %w", l.bucketName, errLoaderClosed)
+	}
+
+	if len(k) == 0 {
+		return fmt.Errorf("add %s: %w", l.bucketName, storage.ErrEmptyKey)
+	}
+
+	if len(v) == 0 {
+		return fmt.Errorf("add %s: %w", l.bucketName, storage.ErrEmptyValue)
+	}
+
+	l.items[string(k)] = append([]byte{}, v...)
+	if len(l.items) >= l.size {
+		return l.Flush()
+	}
+
+	return nil
+}
+
+func (l *bulkLoader) Flush() error {
+	if len(l.items) == 0 {
+		return nil
+	}
+
+	err := l.s.mset(l.bucketName, l.items, l.s.batch)
+	if err != nil {
+		return err
+	}
+
+	l.items = make(map[string][]byte, l.size)
+	return nil
+}
+
+func (l *bulkLoader) Close() error {
+	if l.closed {
+		return nil
+	}
+
+	err := l.Flush()
+	if err != nil {
+		return err
+	}
+
+	l.closed = true
+	return nil
+}
@@ -0,0 +1,167 @@
+package boltdbstorage
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/uretgec/mydb/storage"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BackupChain adds a backup to the chain kept in dir (see storage.Chain). A full backup copies the db
+// and starts logging changed keys (see storage.ChangesBucket), incremental and differential ones only
+// hold the keys changed since the previous or the last full backup. When the changelog does not follow
+// the chain, e.g. after a Restore, a full backup is taken whatever kind asks for.
+func (s *Store) BackupChain(dir string, kind storage.BackupKind) (*storage.ChainBackup, error) {
+	if s.readOnly {
+		return nil, fmt.Errorf("backupchain: %w", storage.ErrReadOnly)
+	}
+
+	// Create dir if necessary
+	_ = storage.CreateDir(dir)
+
+	// No writes while the backup and the changelog move on together
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, b, err := storage.NextChainBackup(s.db, dir, backend, kind)
+	if err != nil {
+		return nil, fmt.Errorf("backupchain: %w", err)
+	}
+
+	var files []string
+	if b.Kind == storage.BackupFull {
+		files = []string{b.Name + ".backup", b.Name + ".manifest"}
+		err = s.db.View(func(t *bolt.Tx) error {
+			return s.backup(t, dir, b.Name)
+		})
+
+		if err == nil {
+			err = s.db.Update(func(t *bolt.Tx) error {
+				return storage.ResetChangelog(t, c.ID)
+			})
+		}
+	} else {
+		files = []string{b.Name + ".changes"}
+		err = s.writeChanges(filepath.Join(dir, files[0]), b.Kind)
+	}
+
+	if err == nil {
+		err = c.Add(dir, b, files...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("backupchain: %w", err)
+	}
+
+	return &b, nil
+}
+
+// RestoreChain restores the store as of backup seq of the chain in dir, -1 for the last one: the
+// differential and incremental backups after the full one are replayed on the decoded full backup,
+// which is then swapped in like Restore does, so the db is only replaced once everything applied.
+// Every file is checked against its checksum first. The changelog is dropped, so the next
+// BackupChain is full.
+func (s *Store) RestoreChain(dir string, seq int) error {
+	if s.readOnly {
+		return fmt.Errorf("restorechain: %w", storage.ErrReadOnly)
+	}
+
+	plan, err := storage.ChainPlan(dir, backend, seq)
+	if err != nil {
+		return fmt.Errorf("restorechain: %w", err)
+	}
+
+	return s.restore(dir, plan[0].Name, func(t *bolt.Tx) error {
+		err := storage.DropChangelog(t)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range plan[1:] {
+			err := storage.ReadChanges(filepath.Join(dir, b.Name+".changes"), s.backupOptions.Key, func(change storage.Change) error {
+				return s.apply(t, change)
+			})
+
+			if err != nil {
+				return fmt.Errorf("backup %d: %w", b.Seq, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// writeChanges writes the logged keys to file, with their current value or as deleted, then
+// moves to the next generation
+func (s *Store) writeChanges(file string, kind storage.BackupKind) error {
+	err := s.db.View(func(t *bolt.Tx) error {
+		return storage.WriteChangelog(t, file, s.backupOptions, kind, func(bucketName, k []byte) (storage.Change, error) {
+			change := storage.Change{Bucket: bucketName, Key: k}
+			if b := t.Bucket(bucketName); b != nil {
+				change.Value = b.Get(k)
+			}
+
+			if change.Value != nil {
+				change.Expire = expiry(t, bucketName, k)
+			}
+
+			return change, nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(storage.NextGeneration)
+}
+
+// apply writes one change of a chain backup, keys of buckets the store no longer declares are skipped.
+// Buckets declared since the full backup are created, t is the backup's.
+func (s *Store) apply(t *bolt.Tx, change storage.Change) error {
+	if !s.registry.Has(change.Bucket) {
+		return nil
+	}
+
+	b, err := t.CreateBucketIfNotExists(change.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if change.Value == nil {
+		err := b.Delete(change.Key)
+		if err == nil {
+			err = storage.DeleteValue(t, change.Bucket, change.Key)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return setExpiry(t, change.Bucket, change.Key, 0)
+	}
+
+	err = b.Put(change.Key, change.Value)
+	if err == nil {
+		err = storage.SetValue(t, change.Bucket, change.Key, change.Value)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return setExpiry(t, change.Bucket, change.Key, change.Expire)
+}
+
+// logBucket records every key of a bucket about to be emptied
+func logBucket(t *bolt.Tx, bucketName []byte) error {
+	if t.Bucket(storage.ChangesBucket) == nil {
+		return nil
+	}
+
+	return t.Bucket(bucketName).ForEach(func(k, _ []byte) error {
+		return storage.LogChange(t, bucketName, k)
+	})
+}
@@ -2,92 +2,179 @@ package boltdbstorage
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+var _ interfaces.Storage = (*Store)(nil)
+
+// backend names the archives of this store, archiveName is the Backup filename inside them
+const (
+	backend     = "boltdb"
+	archiveName = "snapshot"
+)
+
 type Store struct {
-	db         *bolt.DB
-	bucketList []string
-	readOnly   bool
-	indexList  []string
-	allBuckets []string
+	mu       sync.RWMutex // write locked while Restore swaps db
+	db       *bolt.DB
+	file     string
+	options  *bolt.Options
+	registry *storage.Registry
+	readOnly bool
+
+	expireInterval time.Duration
+	sweeperStop    chan struct{}
+	sweeperDone    chan struct{}
+
+	backupOptions storage.BackupOptions
+	valueIndexed  map[string]bool // buckets passed to ValueIndex
 }
 
-func NewStore(bucketList, indexList []string, path string, dbName string, readOnly bool) (*Store, error) {
+// NewStore opens "<path><dbName>.db". Buckets and indexes created with CreateBucket and CreateIndex are
+// kept in the db, reopening it finds them without listing them again.
+func NewStore(bucketList, indexList []string, path string, dbName string, readOnly bool, opts ...Option) (*Store, error) {
 	s := &Store{}
-	s.bucketList = bucketList
 	s.readOnly = readOnly
-	s.indexList = indexList
-	s.allBuckets = append(bucketList, indexList...)
+	s.registry = storage.NewRegistry(bucketList, indexList)
+
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return s, err
+		}
+	}
 
 	// Create dir if not exist
 	_ = storage.CreateDir(path)
 
 	// Open DB
-	db, err := bolt.Open(fmt.Sprintf("%s%s.db", path, dbName), 0600, &bolt.Options{ReadOnly: readOnly})
+	s.file = fmt.Sprintf("%s%s.db", path, dbName)
+	s.options = &bolt.Options{ReadOnly: readOnly}
+
+	db, err := s.open()
 	if err != nil {
 		return s, err
 	}
 
-	if !readOnly {
+	s.db = db
+
+	if s.expireInterval > 0 && !readOnly {
+		s.sweeperStop = make(chan struct{})
+		s.sweeperDone = make(chan struct{})
+		go s.sweep()
+	}
+
+	return s, nil
+}
+
+// open opens the db file, adds the buckets it registered to the store and creates the declared ones
+func (s *Store) open() (*bolt.DB, error) {
+	db, err := bolt.Open(s.file, 0600, s.options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.View(func(t *bolt.Tx) error {
+		return s.registry.Load(t)
+	})
+
+	if err == nil && !s.readOnly {
 		err = db.Update(func(t *bolt.Tx) error {
-			// Create Bucket
-			for _, bucketName := range s.bucketList {
+			for _, bucketName := range s.registry.All() {
 				_, err := t.CreateBucketIfNotExists([]byte(bucketName))
 				if err != nil {
 					return err
 				}
 			}
 
-			// Create Index
-			for _, indexName := range s.indexList {
-				_, err := t.CreateBucketIfNotExists([]byte(indexName))
-				if err != nil {
-					return err
-				}
+			err := s.registry.Save(t)
+			if err != nil {
+				return err
 			}
 
-			return nil
+			return s.syncValueIndexes(t)
 		})
+	}
 
-		if err != nil {
-			return s, err
-		}
+	if err != nil {
+		_ = db.Close()
+		return nil, err
 	}
 
-	s.db = db
-	return s, nil
+	return db, nil
+}
+
+// view, update and batch run bolt transactions under the store lock
+func (s *Store) view(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(fn)
+}
+
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(fn)
+}
+
+func (s *Store) batch(fn func(*bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Batch(fn)
 }
 
 func (s *Store) CloseStore() error {
+	if s.sweeperStop != nil {
+		close(s.sweeperStop)
+		<-s.sweeperDone
+		s.sweeperStop = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return s.db.Close()
 }
 
 func (s *Store) SyncStore() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	s.db.Sync()
 }
 
 func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
+	return s.set(bucketName, k, v, 0)
+}
+
+// set writes a key expiring at expire (unix nano), 0 for no expiry
+func (s *Store) set(bucketName []byte, k []byte, v []byte, expire int64) ([]byte, error) {
 	if s.readOnly {
-		return nil, errors.New("readonly mod active")
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrReadOnly)
 	}
 
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	if len(v) == 0 {
-		return nil, errors.New("value not found")
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyValue)
 	}
 
-	err := s.db.Update(func(t *bolt.Tx) error {
+	err := s.update(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
 
 		if len(k) == 0 {
@@ -95,7 +182,20 @@ func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
 			k = storage.U64tob(int(id))
 		}
 
-		return b.Put(k, v)
+		err := b.Put(k, v)
+		if err == nil {
+			err = storage.SetValue(t, bucketName, k, v)
+		}
+
+		if err == nil {
+			err = storage.LogChange(t, bucketName, k)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return setExpiry(t, bucketName, k, expire)
 	})
 
 	if len(k) == 0 {
@@ -105,17 +205,12 @@ func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
 	return k, err
 }
 
+// Get returns a copy of the value, bolt's own is only valid inside the transaction. See ViewValue to skip the copy.
 func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
-	}
-
 	var item []byte
-	err := s.db.View(func(t *bolt.Tx) error {
-		b := t.Bucket(bucketName)
-		rxData := b.Get(k)
-		if rxData != nil {
-			item = rxData
+	err := s.viewValue("get", bucketName, k, func(v []byte) error {
+		if v != nil {
+			item = append([]byte{}, v...)
 		}
 
 		return nil
@@ -124,18 +219,42 @@ func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
 	return item, err
 }
 
+// ViewValue calls fn with the value of k straight from bolt's mmap, nil for a missing or expired key. The value
+// is only valid while fn runs and must not be changed: copy what fn keeps. Do not call other Store methods from fn.
+func (s *Store) ViewValue(bucketName []byte, k []byte, fn func(v []byte) error) error {
+	return s.viewValue("viewvalue", bucketName, k, fn)
+}
+
+func (s *Store) viewValue(op string, bucketName []byte, k []byte, fn func(v []byte) error) error {
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	return s.view(func(t *bolt.Tx) error {
+		v := t.Bucket(bucketName).Get(k)
+		if v != nil && expired(t, bucketName, k) {
+			v = nil
+		}
+
+		return fn(v)
+	})
+}
+
 func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("mget %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	items := make(map[string]interface{})
 
-	err = s.db.View(func(t *bolt.Tx) error {
+	err = s.view(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
 
 		for index, key := range keys {
 			rxData := b.Get(key)
+			if expired(t, bucketName, key) {
+				rxData = nil
+			}
 
 			items[fmt.Sprintf("%d:%s", index, key)] = string(rxData)
 		}
@@ -158,26 +277,26 @@ Next()   Move to the next key.
 Prev()   Move to the previous key.
 */
 func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("list %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	counter := 1
 
 	items := []string{}
 
-	err = s.db.View(func(t *bolt.Tx) error {
+	err = s.view(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
 		c := b.Cursor()
 
 		if len(k) > 0 {
 			for key, value := c.Seek(k); key != nil; key, value = c.Next() {
-				if bytes.Equal(key, k) {
+				if bytes.Equal(key, k) || expired(t, bucketName, key) {
 					continue
 				}
 
 				var v []byte
-				if storage.Contains(s.indexList, bucketName) {
+				if s.registry.IsIndex(bucketName) {
 					kv := storage.KV{
 						Key:   string(key),
 						Value: string(value),
@@ -197,9 +316,12 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 			}
 		} else {
 			for key, value := c.First(); key != nil; key, value = c.Next() {
+				if expired(t, bucketName, key) {
+					continue
+				}
 
 				var v []byte
-				if storage.Contains(s.indexList, bucketName) {
+				if s.registry.IsIndex(bucketName) {
 					kv := storage.KV{
 						Key:   string(key),
 						Value: string(value),
@@ -230,26 +352,32 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 }
 
 func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("prevlist %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	counter := 1
 
 	items := []string{}
 
-	err = s.db.View(func(t *bolt.Tx) error {
+	err = s.view(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
 		c := b.Cursor()
 
 		if len(k) > 0 {
-			for key, value := c.Seek(k); key != nil; key, value = c.Prev() {
-				if bytes.Equal(key, k) {
+			// Seek lands on the first key >= cursor (or nowhere when the cursor is past the last key)
+			key, value := c.Seek(k)
+			if key == nil {
+				key, value = c.Last()
+			}
+
+			for ; key != nil; key, value = c.Prev() {
+				if bytes.Compare(key, k) >= 0 || expired(t, bucketName, key) {
 					continue
 				}
 
 				var v []byte
-				if storage.Contains(s.indexList, bucketName) {
+				if s.registry.IsIndex(bucketName) {
 					kv := storage.KV{
 						Key:   string(key),
 						Value: string(value),
@@ -269,9 +397,12 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 			}
 		} else {
 			for key, value := c.Last(); key != nil; key, value = c.Prev() {
+				if expired(t, bucketName, key) {
+					continue
+				}
 
 				var v []byte
-				if storage.Contains(s.indexList, bucketName) {
+				if s.registry.IsIndex(bucketName) {
 					kv := storage.KV{
 						Key:   string(key),
 						Value: string(value),
@@ -301,16 +432,75 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 	return items, nil
 }
 
+// Scan returns the items of the key range o selects (see storage.ScanOptions), seeking to its first key
+func (s *Store) Scan(bucketName []byte, o storage.ScanOptions) ([]storage.KV, error) {
+	items := []storage.KV{}
+	err := s.scan("scan", bucketName, o, func(k, v []byte) {
+		items = append(items, storage.KV{Key: string(k), Value: string(v)})
+	})
+
+	return items, err
+}
+
+// Iterator streams the items of the key range o selects, storage.IteratorBatch items per transaction
+func (s *Store) Iterator(bucketName []byte, o storage.ScanOptions) (interfaces.Iterator, error) {
+	return s.iterator("iterator", bucketName, o)
+}
+
+// ForEach calls fn with every item of bucketName in key order until fn fails, outside any transaction so
+// fn can use the store. fn returning storage.ErrStop stops early without error.
+func (s *Store) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	it, err := s.iterator("foreach", bucketName, storage.ScanOptions{})
+	if err != nil {
+		return err
+	}
+
+	return it.ForEach(fn)
+}
+
+func (s *Store) iterator(op string, bucketName []byte, o storage.ScanOptions) (*storage.BatchIterator, error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	return storage.NewBatchIterator(o, storage.IteratorBatch, func(o storage.ScanOptions) ([]storage.Item, error) {
+		items := []storage.Item{}
+		err := s.scan(op, bucketName, o, func(k, v []byte) {
+			items = append(items, storage.Item{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+		})
+
+		return items, err
+	}), nil
+}
+
+// scan calls fn with the items of the range o selects, skipping expired keys. k and v are only valid during fn.
+func (s *Store) scan(op string, bucketName []byte, o storage.ScanOptions, fn func(k, v []byte)) error {
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	return s.view(func(t *bolt.Tx) error {
+		return o.Walk(t.Bucket(bucketName).Cursor(), func(k, v []byte) (bool, error) {
+			if expired(t, bucketName, k) {
+				return false, nil
+			}
+
+			fn(k, v)
+			return true, nil
+		})
+	})
+}
+
 func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return false, errors.New("unknown bucket name")
+	if !s.registry.Has(bucketName) {
+		return false, fmt.Errorf("keyexist %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	var exists bool
-	err := s.db.View(func(t *bolt.Tx) error {
+	err := s.view(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
 		rxData := b.Get(k)
-		if rxData != nil {
+		if rxData != nil && !expired(t, bucketName, k) {
 			exists = true
 		}
 
@@ -320,60 +510,87 @@ func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
 	return exists, err
 }
 
-func (s *Store) ValueExist(bucketName []byte, v []byte) (bool, error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return false, errors.New("unknown bucket name")
+func (s *Store) Delete(bucketName []byte, k []byte) error {
+	if s.readOnly {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrReadOnly)
 	}
 
-	var exists bool
-	err := s.db.View(func(t *bolt.Tx) error {
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrEmptyKey)
+	}
+
+	return s.update(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
-		c := b.Cursor()
+		err := b.Delete(k)
+		if err == nil {
+			err = storage.DeleteValue(t, bucketName, k)
+		}
 
-		for key, value := c.First(); key != nil; key, value = c.Next() {
-			check := bytes.Compare(value, v)
-			if check == 0 {
-				exists = true
-				break
-			}
+		if err == nil {
+			err = storage.LogChange(t, bucketName, k)
 		}
 
-		return nil
+		if err != nil {
+			return err
+		}
+
+		return setExpiry(t, bucketName, k, 0)
 	})
+}
 
-	return exists, err
+// CreateBucket adds a bucket at runtime, kept in the db for the next NewStore.
+// Creating a bucket that already exists does nothing.
+func (s *Store) CreateBucket(bucketName []byte) error {
+	return s.create("createbucket", bucketName, storage.KindBucket)
 }
 
-func (s *Store) Delete(bucketName []byte, k []byte) error {
+// CreateIndex adds an index at runtime like CreateBucket
+func (s *Store) CreateIndex(indexName []byte) error {
+	return s.create("createindex", indexName, storage.KindIndex)
+}
+
+func (s *Store) create(op string, name []byte, kind storage.BucketKind) error {
 	if s.readOnly {
-		return errors.New("readonly mod active")
+		return fmt.Errorf("%s %s: %w", op, name, storage.ErrReadOnly)
 	}
 
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return errors.New("unknown bucket name")
-	}
+	err := s.update(func(t *bolt.Tx) error {
+		err := s.registry.Create(t, name, kind)
+		if err != nil {
+			return err
+		}
 
-	if len(k) == 0 {
-		return errors.New("key not found")
-	}
+		_, err = t.CreateBucketIfNotExists(name)
+		if err != nil || !s.valueIndexed[string(name)] {
+			return err
+		}
 
-	return s.db.Update(func(t *bolt.Tx) error {
-		b := t.Bucket(bucketName)
-		return b.Delete(k)
+		return storage.CreateValueIndex(t, name)
 	})
+
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", op, name, err)
+	}
+
+	s.registry.Add(name, kind)
+	return nil
 }
 
 func (s *Store) HasBucket(bucketName []byte) bool {
-	return storage.Contains(s.allBuckets, bucketName)
+	return s.registry.Has(bucketName)
 }
 
 func (s *Store) StatsBucket(bucketName []byte) int {
-	if !storage.Contains(s.allBuckets, bucketName) {
+	if !s.registry.Has(bucketName) {
 		return 0
 	}
 
 	var stats int
-	err := s.db.View(func(t *bolt.Tx) error {
+	err := s.view(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
 
 		stats = b.Stats().KeyN // total count key/value
@@ -389,49 +606,238 @@ func (s *Store) StatsBucket(bucketName []byte) int {
 }
 
 func (s *Store) ListBucket() (buckets []string, err error) {
-	bucketList := []string{}
+	return s.registry.Buckets(), nil
+}
+
+func (s *Store) DeleteBucket(bucketName []byte) error {
+	if s.readOnly {
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	// Declared buckets stay usable, so recreate it empty
+	return s.update(func(t *bolt.Tx) error {
+		err := logBucket(t, bucketName)
+		if err != nil {
+			return err
+		}
+
+		err = t.DeleteBucket(bucketName)
+		if err != nil {
+			return err
+		}
+
+		_, err = t.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
 
-	err = s.db.View(func(t *bolt.Tx) error {
-		return t.ForEach(func(name []byte, b *bolt.Bucket) error {
-			if storage.Contains(s.bucketList, name) {
-				bucketList = append(bucketList, string(name))
+		if storage.HasValueIndex(t, bucketName) {
+			err = storage.DropValueIndex(t, bucketName)
+			if err == nil {
+				err = storage.CreateValueIndex(t, bucketName)
 			}
 
-			return nil
-		})
+			if err != nil {
+				return err
+			}
+		}
+
+		if root := t.Bucket(ttlBucket); root != nil && root.Bucket(bucketName) != nil {
+			return root.DeleteBucket(bucketName)
+		}
+
+		return nil
 	})
+}
 
+// Backup writes a copy of the db to path/filename.backup and its manifest (see storage.BackupManifest)
+// to path/filename.manifest. The copy is compressed and encrypted as the backup options ask.
+func (s *Store) Backup(path, filename string) error {
+	return s.view(func(tx *bolt.Tx) error {
+		return s.backup(tx, path, filename)
+	})
+}
+
+func (s *Store) backup(tx *bolt.Tx, path, filename string) error {
+	// Create dir if necessary
+	_ = storage.CreateDir(path)
+
+	file := filename + ".backup"
+	err := tx.CopyFile(strings.TrimSuffix(path, "/")+"/"+file, 0600)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return bucketList, nil
+	m, err := storage.NewBackupManifest(backend, path, file, s.registry.All(), file)
+	if err == nil {
+		err = m.Encode(path, s.backupOptions)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteManifest(storage.ManifestFile(path, filename), m)
 }
 
-func (s *Store) DeleteBucket(bucketName []byte) error {
+// Restore replaces the db with a backup written by Backup. The backup is verified against its manifest
+// first (see storage.VerifyBackup), decoded when it is compressed or encrypted and swapped in under the
+// open store; on any failure the current db is kept as it was.
+func (s *Store) Restore(path, filename string) error {
+	return s.restore(path, filename, nil)
+}
+
+// restore is Restore, replay runs on the decoded backup in one transaction before it is swapped in
+func (s *Store) restore(path, filename string, replay func(*bolt.Tx) error) error {
 	if s.readOnly {
-		return errors.New("readonly mod active")
+		return fmt.Errorf("restore: %w", storage.ErrReadOnly)
 	}
 
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return errors.New("unknown bucket name")
+	backup := strings.TrimSuffix(path, "/") + "/" + filename + ".backup"
+
+	// Backups without manifest only get bolt's consistency check
+	var err error
+	if _, statErr := os.Stat(storage.ManifestFile(path, filename)); statErr == nil {
+		err = storage.VerifyBackupWithKey(path, filename, s.backupOptions.Key)
 	}
 
-	return s.db.Update(func(t *bolt.Tx) error {
-		return t.DeleteBucket(bucketName)
-	})
+	if err != nil {
+		return fmt.Errorf("restore %s: %w", backup, err)
+	}
+
+	// Decode next to the db, so the final rename stays on one filesystem
+	tmp := s.file + ".restore"
+	err = storage.DecodeFile(backup, tmp, s.backupOptions.Key)
+	if err == nil {
+		err = storage.CheckBoltFile(tmp)
+	}
+
+	if err == nil && replay != nil {
+		err = replayFile(tmp, replay)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("restore %s: %w", backup, err)
+	}
+	defer os.Remove(tmp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.db.Close()
+	if err != nil {
+		return err
+	}
+
+	// Keep the current db until the backup opened fine
+	old := s.file + ".old"
+	err = os.Rename(s.file, old)
+	if err == nil {
+		err = os.Rename(tmp, s.file)
+		if err != nil {
+			_ = os.Rename(old, s.file)
+		}
+	}
+
+	if err == nil {
+		var db *bolt.DB
+		db, err = s.open()
+		if err == nil {
+			s.db = db
+			return os.Remove(old)
+		}
+
+		_ = os.Rename(old, s.file)
+	}
+
+	// Reopen the untouched db
+	db, openErr := s.open()
+	if openErr != nil {
+		return fmt.Errorf("restore: %v, reopen: %w", err, openErr)
+	}
+
+	s.db = db
+	return fmt.Errorf("restore: %w", err)
 }
 
-func (s *Store) Backup(path, filename string) error {
-	return s.db.View(func(tx *bolt.Tx) error {
-		// Create dir if necessary
-		_ = storage.CreateDir(path)
+// replayFile runs fn in one transaction on the bolt file
+func replayFile(file string, fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(fn)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
 
-		path = strings.TrimSuffix(path, "/") + "/" + filename + ".backup"
-		return tx.CopyFile(path, 0600)
+	return err
+}
+
+// BackupTo streams a backup archive (see storage.ArchiveWriter) of the db to w, compressed and
+// encrypted as a whole as the backup options ask
+func (s *Store) BackupTo(w io.Writer) error {
+	bw, err := storage.NewBackupWriter(w, s.backupOptions)
+	if err != nil {
+		return err
+	}
+
+	err = s.view(func(tx *bolt.Tx) error {
+		a, err := storage.NewArchiveWriter(bw, backend, archiveName+".backup")
+		if err != nil {
+			return err
+		}
+
+		err = a.Add(archiveName+".backup", tx.Size(), func(w io.Writer) error {
+			_, err := tx.WriteTo(w)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return a.Close()
 	})
+
+	if err != nil {
+		return err
+	}
+
+	return bw.Close()
 }
 
-func (s *Store) Restore(path, filename string) error {
-	return errors.New("not implemented")
+// RestoreFrom reads an archive written by BackupTo and restores it like Restore
+func (s *Store) RestoreFrom(r io.Reader) error {
+	if s.readOnly {
+		return fmt.Errorf("restorefrom: %w", storage.ErrReadOnly)
+	}
+
+	dir, err := os.MkdirTemp("", "mydb-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	r, err = storage.NewBackupReader(r, s.backupOptions.Key)
+	if err != nil {
+		return fmt.Errorf("restorefrom: %w", err)
+	}
+
+	m, err := storage.ReadArchive(r, dir)
+	if err != nil {
+		return fmt.Errorf("restorefrom: %w", err)
+	}
+
+	if m.Backend != backend {
+		return fmt.Errorf("restorefrom: archive of %s, not %s", m.Backend, backend)
+	}
+
+	return s.Restore(dir, archiveName)
 }
@@ -2,10 +2,18 @@ package boltdbstorage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+	"github.com/uretgec/mydb/storage/storagetest"
 
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestCmd(t *testing.T) {
@@ -34,3 +42,397 @@ func OpenStore() (*Store, error) {
 func DeleteStore() error {
 	return os.RemoveAll("./storage_test.db")
 }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(bucketList, indexList []string, path, dbName string, readOnly bool) (interfaces.Storage, error) {
+		return NewStore(bucketList, indexList, path, dbName, readOnly)
+	})
+}
+
+func TestExpireInterval(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false, ExpireInterval(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), []byte("test_1"), []byte("number one"), time.Second)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	// The sweeper deletes the expired key and its index entry
+	assert.Eventually(t, func() bool {
+		return store.StatsBucket([]byte("posts")) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestRestore(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = store.Backup(path, "snapshot")
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	// Writes made after the backup are gone
+	err = store.Restore(path, "snapshot")
+	assert.NoError(t, err)
+
+	exist, err := store.KeyExist([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exist)
+
+	exist, err = store.KeyExist([]byte("posts"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, false, exist)
+
+	// A broken backup leaves the db as it was
+	err = os.WriteFile(path+"broken.backup", []byte("not a bolt file"), 0600)
+	assert.NoError(t, err)
+
+	err = store.Restore(path, "broken")
+	assert.Error(t, err)
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestBackupChain(t *testing.T) {
+	path := t.TempDir() + "/"
+	dir := path + "chain"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	set := func(k string) {
+		_, err := store.Set([]byte("posts"), []byte(k), []byte("value "+k))
+		assert.NoError(t, err)
+	}
+
+	exist := func(k string) bool {
+		exist, err := store.KeyExist([]byte("posts"), []byte(k))
+		assert.NoError(t, err)
+		return exist
+	}
+
+	set("a")
+	set("b")
+	b, err := store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.BackupFull, b.Kind) // a chain starts with a full backup
+
+	set("c")
+	assert.NoError(t, store.Delete([]byte("posts"), []byte("a")))
+	b, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.BackupIncremental, b.Kind)
+
+	set("d")
+	_, err = store.BackupChain(dir, storage.BackupDifferential)
+	assert.NoError(t, err)
+
+	set("e")
+	_, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+
+	set("f")
+
+	// Back to the first incremental
+	err = store.RestoreChain(dir, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true, false, false, false}, []bool{exist("a"), exist("b"), exist("c"), exist("d"), exist("e"), exist("f")})
+
+	// Up to the last one: full, differential, incremental
+	err = store.RestoreChain(dir, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true, true, true, false}, []bool{exist("a"), exist("b"), exist("c"), exist("d"), exist("e"), exist("f")})
+
+	// The changelog is gone after a restore, the chain goes on with a full backup
+	b, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.BackupFull, b.Kind)
+
+	// A changed file is caught before anything is restored
+	err = os.WriteFile(dir+"/000001-incremental.changes", []byte("changed"), 0600)
+	assert.NoError(t, err)
+
+	err = store.RestoreChain(dir, 1)
+	assert.Error(t, err)
+	assert.Equal(t, true, exist("e"))
+
+	// So is a replay that fails, once the file passes its checksum
+	c, err := storage.ReadChain(dir)
+	assert.NoError(t, err)
+
+	c.Backups[1].Files["000001-incremental.changes"], err = storage.FileChecksum(dir + "/000001-incremental.changes")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Write(dir))
+
+	err = store.RestoreChain(dir, 1)
+	assert.Error(t, err)
+	assert.Equal(t, []bool{false, true, true, true, true, false}, []bool{exist("a"), exist("b"), exist("c"), exist("d"), exist("e"), exist("f")})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestVerifyBackup(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = store.Backup(path, "snapshot")
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = storage.VerifyBackup(path, "snapshot")
+	assert.NoError(t, err)
+
+	m := &storage.BackupManifest{}
+	err = storage.ReadManifest(path+"snapshot.manifest", m)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, m.Buckets["posts"])
+
+	// A manifest that does not match the backup
+	m.Buckets["posts"] = 2
+	err = storage.WriteManifest(path+"snapshot.manifest", m)
+	assert.NoError(t, err)
+
+	err = storage.VerifyBackup(path, "snapshot")
+	assert.Error(t, err)
+
+	// A backup file that changed since
+	f, err := os.OpenFile(path+"snapshot.backup", os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("changed"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	m.Buckets["posts"] = 1
+	err = storage.WriteManifest(path+"snapshot.manifest", m)
+	assert.NoError(t, err)
+
+	err = storage.VerifyBackup(path, "snapshot")
+	assert.Error(t, err)
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	path := t.TempDir() + "/"
+	key := bytes.Repeat([]byte("k"), 32)
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false, CompressBackups(0), EncryptBackups(key))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = store.Backup(path, "snapshot")
+	assert.NoError(t, err)
+
+	encoded, err := storage.IsEncoded(path + "snapshot.backup")
+	assert.NoError(t, err)
+	assert.Equal(t, true, encoded)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	err = store.Restore(path, "snapshot")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	var buf bytes.Buffer
+	err = store.BackupTo(&buf)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	err = store.RestoreFrom(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	// A changed header fails like a changed chunk: the flags, then the salt
+	for _, i := range []int{5, 6} {
+		tampered := append([]byte{}, buf.Bytes()...)
+		tampered[i] ^= 1
+
+		err = store.RestoreFrom(bytes.NewReader(tampered))
+		assert.Equal(t, true, errors.Is(err, storage.ErrBackupKey))
+	}
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Without the key nothing is restored
+	other, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false)
+	assert.NoError(t, err)
+
+	err = other.Restore(path, "snapshot")
+	assert.Equal(t, true, errors.Is(err, storage.ErrBackupKey))
+
+	err = other.RestoreFrom(bytes.NewReader(buf.Bytes()))
+	assert.Equal(t, true, errors.Is(err, storage.ErrBackupKey))
+
+	err = other.CloseStore()
+	assert.NoError(t, err)
+
+	// Nor with a wrong one
+	other, err = NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false, EncryptBackups(bytes.Repeat([]byte("x"), 32)))
+	assert.NoError(t, err)
+
+	err = other.Restore(path, "snapshot")
+	assert.Equal(t, true, errors.Is(err, storage.ErrBackupKey))
+
+	err = other.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestValueIndex(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts"}, []string{"posts"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	for k, v := range map[string]string{"1": "draft", "2": "published", "3": "draft"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(v))
+		assert.NoError(t, err)
+	}
+
+	// Without value index the bucket is scanned
+	keys, err := store.KeysByValue([]byte("posts"), []byte("draft"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "3"}, keys)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Built for the data already there
+	store, err = NewStore(nil, nil, path, "storage_test", false, ValueIndex("posts", "options"))
+	assert.NoError(t, err)
+
+	keys, err = store.KeysByValue([]byte("posts"), []byte("draft"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "3"}, keys)
+
+	err = store.Update(func(tx interfaces.Tx) error {
+		_, err := tx.Set([]byte("posts"), []byte("3"), []byte("published"))
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete([]byte("posts"), []byte("2"))
+	})
+	assert.NoError(t, err)
+
+	err = store.MSet([]byte("options"), map[string][]byte{"a": []byte("on"), "b": []byte("on")})
+	assert.NoError(t, err)
+
+	keys, err = store.KeysByValue([]byte("posts"), []byte("published"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3"}, keys)
+
+	exists, err := store.ValueExist([]byte("options"), []byte("on"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+
+	assert.NoError(t, store.DeleteBucket([]byte("options")))
+	exists, err = store.ValueExist([]byte("options"), []byte("on"))
+	assert.NoError(t, err)
+	assert.Equal(t, false, exists)
+
+	err = store.view(func(tx *bolt.Tx) error {
+		assert.Equal(t, []string{"options", "posts"}, storage.ValueIndexes(tx))
+		assert.Equal(t, 1, len(storage.ValueKeys(tx, []byte("posts"), []byte("draft"))))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Dropped once no longer asked for
+	store, err = NewStore(nil, nil, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	err = store.view(func(tx *bolt.Tx) error {
+		assert.Equal(t, []string{}, storage.ValueIndexes(tx))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestValueLifetime(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts"}, []string{"posts"}, t.TempDir()+"/", "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("options"), []byte("a"), []byte("value a"))
+	assert.NoError(t, err)
+
+	// A copy, bolt's mmap is read only
+	v, err := store.Get([]byte("options"), []byte("a"))
+	assert.NoError(t, err)
+	v[0] = 'V'
+
+	// Grow the db so bolt remaps it
+	items := map[string][]byte{}
+	for i := 0; i < 5000; i++ {
+		items[fmt.Sprintf("key%05d", i)] = bytes.Repeat([]byte("x"), 1024)
+	}
+	assert.NoError(t, store.MSet([]byte("posts"), items))
+
+	assert.Equal(t, "Value a", string(v))
+
+	v, err = store.Get([]byte("options"), []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "value a", string(v))
+
+	var size int
+	err = store.ViewValue([]byte("options"), []byte("a"), func(v []byte) error {
+		size = len(v)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, size)
+
+	err = store.ViewValue([]byte("options"), []byte("missing"), func(v []byte) error {
+		assert.Nil(t, v)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	failed := errors.New("failed")
+	err = store.ViewValue([]byte("options"), []byte("a"), func(v []byte) error {
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	err = store.ViewValue([]byte("unknown"), []byte("a"), func(v []byte) error { return nil })
+	assert.Equal(t, true, errors.Is(err, storage.ErrUnknownBucket))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
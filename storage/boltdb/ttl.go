@@ -0,0 +1,180 @@
+package boltdbstorage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ttlBucket holds one nested bucket per data bucket, mapping key -> expiry (unix nano)
+var ttlBucket = []byte("[ttl]")
+
+// SetWithTTL writes like Set, the key expires after ttl
+func (s *Store) SetWithTTL(bucketName []byte, k []byte, v []byte, ttl time.Duration) ([]byte, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("setwithttl %s: invalid ttl %s", bucketName, ttl)
+	}
+
+	return s.set(bucketName, k, v, time.Now().Add(ttl).UnixNano())
+}
+
+// TTL returns the time left before the key expires, 0 for a key without expiry.
+// Missing or expired keys return storage.ErrNotFound.
+func (s *Store) TTL(bucketName []byte, k []byte) (time.Duration, error) {
+	if !s.registry.Has(bucketName) {
+		return 0, fmt.Errorf("ttl %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	var ttl time.Duration
+	err := s.view(func(t *bolt.Tx) error {
+		if t.Bucket(bucketName).Get(k) == nil || expired(t, bucketName, k) {
+			return fmt.Errorf("ttl %s: %w", bucketName, storage.ErrNotFound)
+		}
+
+		if expire := expiry(t, bucketName, k); expire > 0 {
+			ttl = time.Until(time.Unix(0, expire))
+		}
+
+		return nil
+	})
+
+	return ttl, err
+}
+
+// Expire deletes every expired key, the sweeper started by ExpireInterval calls it
+func (s *Store) Expire() error {
+	if s.readOnly {
+		return fmt.Errorf("expire: %w", storage.ErrReadOnly)
+	}
+
+	now := time.Now().UnixNano()
+
+	// Find them in a read transaction, so an idle sweeper never writes
+	found := map[string][][]byte{}
+	err := s.view(func(t *bolt.Tx) error {
+		root := t.Bucket(ttlBucket)
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(bucketName, _ []byte) error {
+			return root.Bucket(bucketName).ForEach(func(k, v []byte) error {
+				if int64(storage.Btou64(v)) <= now {
+					found[string(bucketName)] = append(found[string(bucketName)], append([]byte{}, k...))
+				}
+
+				return nil
+			})
+		})
+	})
+
+	if err != nil || len(found) == 0 {
+		return err
+	}
+
+	return s.update(func(t *bolt.Tx) error {
+		for bucketName, keys := range found {
+			for _, k := range keys {
+				// Skip keys written again since
+				if !expired(t, []byte(bucketName), k) {
+					continue
+				}
+
+				if b := t.Bucket([]byte(bucketName)); b != nil {
+					err := b.Delete(k)
+					if err != nil {
+						return err
+					}
+				}
+
+				err := storage.DeleteValue(t, []byte(bucketName), k)
+				if err != nil {
+					return err
+				}
+
+				err = storage.LogChange(t, []byte(bucketName), k)
+				if err != nil {
+					return err
+				}
+
+				err = setExpiry(t, []byte(bucketName), k, 0)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// sweep runs Expire every expireInterval until CloseStore
+func (s *Store) sweep() {
+	defer close(s.sweeperDone)
+
+	ticker := time.NewTicker(s.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.Expire()
+		case <-s.sweeperStop:
+			return
+		}
+	}
+}
+
+// expiry returns the expiry of a key, 0 if it has none
+func expiry(t *bolt.Tx, bucketName []byte, k []byte) int64 {
+	root := t.Bucket(ttlBucket)
+	if root == nil {
+		return 0
+	}
+
+	b := root.Bucket(bucketName)
+	if b == nil {
+		return 0
+	}
+
+	v := b.Get(k)
+	if v == nil {
+		return 0
+	}
+
+	return int64(storage.Btou64(v))
+}
+
+func expired(t *bolt.Tx, bucketName []byte, k []byte) bool {
+	expire := expiry(t, bucketName, k)
+
+	return expire > 0 && expire <= time.Now().UnixNano()
+}
+
+// setExpiry records the expiry of a key, 0 clears it. Every write calls it, so
+// overwriting or deleting a key drops its old ttl.
+func setExpiry(t *bolt.Tx, bucketName []byte, k []byte, expire int64) error {
+	root := t.Bucket(ttlBucket)
+	if expire == 0 {
+		if root == nil || root.Bucket(bucketName) == nil {
+			return nil
+		}
+
+		return root.Bucket(bucketName).Delete(k)
+	}
+
+	root, err := t.CreateBucketIfNotExists(ttlBucket)
+	if err != nil {
+		return err
+	}
+
+	b, err := root.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, storage.U64tob(int(expire)))
+}
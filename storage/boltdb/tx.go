@@ -0,0 +1,117 @@
+package boltdbstorage
+
+import (
+	"fmt"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// tx is a bolt transaction limited to the store's buckets
+type tx struct {
+	s *Store
+	t *bolt.Tx
+}
+
+func (s *Store) Update(fn func(tx interfaces.Tx) error) error {
+	if s.readOnly {
+		return fmt.Errorf("update: %w", storage.ErrReadOnly)
+	}
+
+	return s.update(func(t *bolt.Tx) error {
+		return fn(&tx{s: s, t: t})
+	})
+}
+
+func (s *Store) View(fn func(tx interfaces.Tx) error) error {
+	return s.view(func(t *bolt.Tx) error {
+		return fn(&tx{s: s, t: t})
+	})
+}
+
+func (tx *tx) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("get %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if expired(tx.t, bucketName, k) {
+		return nil, nil
+	}
+
+	return tx.t.Bucket(bucketName).Get(k), nil
+}
+
+func (tx *tx) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
+	if !tx.t.Writable() {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(v) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyValue)
+	}
+
+	b := tx.t.Bucket(bucketName)
+
+	if len(k) == 0 {
+		id, _ := b.NextSequence()
+		k = storage.U64tob(int(id))
+	}
+
+	err := b.Put(k, v)
+	if err == nil {
+		err = storage.SetValue(tx.t, bucketName, k, v)
+	}
+
+	if err == nil {
+		err = storage.LogChange(tx.t, bucketName, k)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k, setExpiry(tx.t, bucketName, k, 0)
+}
+
+func (tx *tx) Delete(bucketName []byte, k []byte) error {
+	if !tx.t.Writable() {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !tx.s.registry.Has(bucketName) {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrEmptyKey)
+	}
+
+	err := tx.t.Bucket(bucketName).Delete(k)
+	if err == nil {
+		err = storage.DeleteValue(tx.t, bucketName, k)
+	}
+
+	if err == nil {
+		err = storage.LogChange(tx.t, bucketName, k)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return setExpiry(tx.t, bucketName, k, 0)
+}
+
+func (tx *tx) Cursor(bucketName []byte) (interfaces.Cursor, error) {
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("cursor %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	return tx.t.Bucket(bucketName).Cursor(), nil
+}
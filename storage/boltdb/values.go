@@ -0,0 +1,106 @@
+package boltdbstorage
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/uretgec/mydb/storage"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ValueExist reports whether a key of bucketName holds v, through the value index of the bucket when it has one (see ValueIndex)
+func (s *Store) ValueExist(bucketName []byte, v []byte) (bool, error) {
+	keys, err := s.keysByValue("valueexist", bucketName, v, 1)
+	return len(keys) > 0, err
+}
+
+// KeysByValue returns the keys of bucketName holding v, sorted, like ValueExist
+func (s *Store) KeysByValue(bucketName []byte, v []byte) ([]string, error) {
+	return s.keysByValue("keysbyvalue", bucketName, v, 0)
+}
+
+// keysByValue returns up to limit keys holding v, 0 for all
+func (s *Store) keysByValue(op string, bucketName []byte, v []byte, limit int) ([]string, error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	keys := []string{}
+	err := s.view(func(t *bolt.Tx) error {
+		b := t.Bucket(bucketName)
+
+		// match adds k and reports whether the limit is reached
+		match := func(k, value []byte) bool {
+			if bytes.Equal(value, v) && !expired(t, bucketName, k) {
+				keys = append(keys, string(k))
+			}
+
+			return limit > 0 && len(keys) >= limit
+		}
+
+		// Hashes may collide, the values decide
+		if storage.HasValueIndex(t, bucketName) {
+			for _, k := range storage.ValueKeys(t, bucketName, v) {
+				if match(k, b.Get(k)) {
+					break
+				}
+			}
+
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, value := c.First(); k != nil; k, value = c.Next() {
+			if match(k, value) {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, err)
+	}
+
+	return keys, nil
+}
+
+// syncValueIndexes drops the value indexes of buckets no longer passed to ValueIndex and builds the missing ones
+func (s *Store) syncValueIndexes(t *bolt.Tx) error {
+	for _, name := range storage.ValueIndexes(t) {
+		if !s.valueIndexed[name] {
+			err := storage.DropValueIndex(t, []byte(name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name := range s.valueIndexed {
+		b := t.Bucket([]byte(name))
+		if b == nil || storage.HasValueIndex(t, []byte(name)) {
+			continue
+		}
+
+		err := storage.CreateValueIndex(t, []byte(name))
+		if err != nil {
+			return err
+		}
+
+		err = b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			return storage.SetValue(t, []byte(name), k, v)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BackupKind selects what a chain backup holds
+type BackupKind string
+
+const (
+	BackupFull         BackupKind = "full"         // the whole store, starts a chain
+	BackupIncremental  BackupKind = "incremental"  // keys changed since the previous backup
+	BackupDifferential BackupKind = "differential" // keys changed since the last full backup
+)
+
+// chainFile is the chain manifest inside a chain directory
+const chainFile = "chain.json"
+
+// Chain is the manifest of a backup chain directory: the backups in the order they were taken
+type Chain struct {
+	ID      string        `json:"id"`
+	Backend string        `json:"backend"`
+	Backups []ChainBackup `json:"backups"`
+}
+
+// ChainBackup is one backup of a chain, Files maps every file it wrote to its sha256
+type ChainBackup struct {
+	Seq     int               `json:"seq"`
+	Kind    BackupKind        `json:"kind"`
+	Name    string            `json:"name"`
+	Created time.Time         `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+// ReadChain reads the chain manifest of dir, an empty chain if there is none yet
+func ReadChain(dir string) (*Chain, error) {
+	data, err := os.ReadFile(filepath.Join(dir, chainFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Chain{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := &Chain{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", chainFile, err)
+	}
+
+	return c, nil
+}
+
+// Write replaces the chain manifest of dir
+func (c *Chain) Write(dir string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, chainFile+".tmp")
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, chainFile))
+}
+
+// Next returns the next backup of the chain, without adding it. A chain starts with a full backup,
+// one is taken whatever kind asks for. New chains get an ID.
+func (c *Chain) Next(kind BackupKind) (ChainBackup, error) {
+	switch kind {
+	case BackupFull, BackupIncremental, BackupDifferential:
+	default:
+		return ChainBackup{}, fmt.Errorf("unknown backup kind %q", kind)
+	}
+
+	if len(c.Backups) == 0 {
+		kind = BackupFull
+	}
+
+	if c.ID == "" {
+		id := make([]byte, 8)
+		_, err := rand.Read(id)
+		if err != nil {
+			return ChainBackup{}, err
+		}
+
+		c.ID = hex.EncodeToString(id)
+	}
+
+	seq := len(c.Backups)
+
+	return ChainBackup{
+		Seq:     seq,
+		Kind:    kind,
+		Name:    fmt.Sprintf("%06d-%s", seq, kind),
+		Created: time.Now().UTC(),
+		Files:   map[string]string{},
+	}, nil
+}
+
+// Add records the checksums of the backup's files and appends it to the chain
+func (c *Chain) Add(dir string, b ChainBackup, files ...string) error {
+	for _, file := range files {
+		sum, err := FileChecksum(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+
+		b.Files[file] = sum
+	}
+
+	c.Backups = append(c.Backups, b)
+
+	return c.Write(dir)
+}
+
+// Plan returns the backups to replay to get the store as of backup seq (-1 for the last one):
+// the last full backup, then the last differential after it and the incrementals after that.
+func (c *Chain) Plan(seq int) ([]ChainBackup, error) {
+	if seq < 0 {
+		seq = len(c.Backups) - 1
+	}
+
+	if seq < 0 || seq >= len(c.Backups) {
+		return nil, fmt.Errorf("chain has no backup %d: %w", seq, ErrNotFound)
+	}
+
+	base := -1
+	for i := seq; i >= 0; i-- {
+		if c.Backups[i].Kind == BackupFull {
+			base = i
+			break
+		}
+	}
+
+	if base < 0 {
+		return nil, fmt.Errorf("chain has no full backup before %d", seq)
+	}
+
+	start := base + 1
+	for i := seq; i > base; i-- {
+		if c.Backups[i].Kind == BackupDifferential {
+			start = i
+			break
+		}
+	}
+
+	plan := []ChainBackup{c.Backups[base]}
+	for i := start; i <= seq; i++ {
+		if i == start || c.Backups[i].Kind == BackupIncremental {
+			plan = append(plan, c.Backups[i])
+		}
+	}
+
+	return plan, nil
+}
+
+// Verify compares the files of the backup with their recorded checksums
+func (b *ChainBackup) Verify(dir string) error {
+	for file, want := range b.Files {
+		sum, err := FileChecksum(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+
+		if sum != want {
+			return fmt.Errorf("backup %d: %s checksum mismatch", b.Seq, file)
+		}
+	}
+
+	return nil
+}
+
+// FileChecksum returns the hex sha256 of a file
+func FileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Change is one key of an incremental or differential backup, Value is nil for a deleted key
+// and Expire is the unix nano expiry, 0 for none.
+type Change struct {
+	Bucket []byte
+	Key    []byte
+	Value  []byte
+	Expire int64
+}
+
+// WriteChanges writes every change passed to add into file, compressed and encrypted as o asks
+func WriteChanges(file string, o BackupOptions, changes func(add func(c Change) error) error) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w, err := NewBackupWriter(f, o)
+	if err == nil {
+		enc := gob.NewEncoder(w)
+		err = changes(func(c Change) error {
+			return enc.Encode(&c)
+		})
+	}
+
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReadChanges calls fn with every change of a file written by WriteChanges, in order. key decrypts
+// encrypted files.
+func ReadChanges(file string, key []byte, fn func(c Change) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := NewBackupReader(f, key)
+	if err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(r)
+	for {
+		c := Change{}
+
+		err = dec.Decode(&c)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = fn(c)
+		if err != nil {
+			return err
+		}
+	}
+}
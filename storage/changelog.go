@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ChangesBucket is the bolt root bucket of the changelog of a backup chain: one nested bucket per data
+// bucket, mapping key -> generation it last changed in. It only exists once the store took a full chain
+// backup, its sequence is the current generation and changelogID names the chain.
+var (
+	ChangesBucket = []byte("[changes]")
+	changelogID   = []byte("[id]")
+)
+
+// NextChainBackup reads the chain of dir, checks it was taken by backend and returns it with its next backup
+// of kind. db holds the changelog: when it does not follow the chain, e.g. after a Restore, the backup is full
+// whatever kind asks for. Nothing is written, the caller adds the backup once its files are.
+func NextChainBackup(db *bolt.DB, dir, backend string, kind BackupKind) (*Chain, ChainBackup, error) {
+	c, err := ReadChain(dir)
+	if err != nil {
+		return nil, ChainBackup{}, err
+	}
+
+	if c.Backend != "" && c.Backend != backend {
+		return nil, ChainBackup{}, fmt.Errorf("chain of %s, not %s", c.Backend, backend)
+	}
+
+	c.Backend = backend
+
+	b, err := c.Next(kind)
+	if err == nil && b.Kind != BackupFull && !follows(db, c) {
+		b, err = c.Next(BackupFull)
+	}
+
+	if err != nil {
+		return nil, ChainBackup{}, err
+	}
+
+	return c, b, nil
+}
+
+// ChainPlan reads the chain of dir, checks it was taken by backend and returns the backups restoring
+// backup seq (see Chain.Plan), every file checked against its checksum
+func ChainPlan(dir, backend string, seq int) ([]ChainBackup, error) {
+	c, err := ReadChain(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Backend != backend {
+		return nil, fmt.Errorf("chain of %s, not %s", c.Backend, backend)
+	}
+
+	plan, err := c.Plan(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range plan {
+		err = b.Verify(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// follows reports whether the changelog of db continues the chain: same chain and the generation
+// the backups since its last full one lead to
+func follows(db *bolt.DB, c *Chain) bool {
+	full := -1
+	for i, b := range c.Backups {
+		if b.Kind == BackupFull {
+			full = i
+		}
+	}
+
+	var ok bool
+	_ = db.View(func(t *bolt.Tx) error {
+		root := t.Bucket(ChangesBucket)
+		ok = full >= 0 && root != nil && string(root.Get(changelogID)) == c.ID &&
+			root.Sequence() == uint64(len(c.Backups)-full)
+		return nil
+	})
+
+	return ok
+}
+
+// ResetChangelog starts an empty changelog for chain id at generation 1
+func ResetChangelog(t *bolt.Tx, id string) error {
+	err := DropChangelog(t)
+	if err != nil {
+		return err
+	}
+
+	root, err := t.CreateBucket(ChangesBucket)
+	if err != nil {
+		return err
+	}
+
+	err = root.Put(changelogID, []byte(id))
+	if err != nil {
+		return err
+	}
+
+	return root.SetSequence(1)
+}
+
+// DropChangelog removes the changelog, the next chain backup is full
+func DropChangelog(t *bolt.Tx) error {
+	if t.Bucket(ChangesBucket) == nil {
+		return nil
+	}
+
+	return t.DeleteBucket(ChangesBucket)
+}
+
+// LogChange records that a key changed, while a chain is running. Keys without bucket are not logged.
+func LogChange(t *bolt.Tx, bucketName []byte, k []byte) error {
+	root := t.Bucket(ChangesBucket)
+	if root == nil || len(bucketName) == 0 {
+		return nil
+	}
+
+	b, err := root.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, U64tob(int(root.Sequence())))
+}
+
+// WriteChangelog writes the logged keys to file as change returns them, incremental backups only take
+// keys of the current generation. NextGeneration moves on once the file is kept.
+func WriteChangelog(t *bolt.Tx, file string, o BackupOptions, kind BackupKind, change func(bucketName, k []byte) (Change, error)) error {
+	root := t.Bucket(ChangesBucket)
+	gen := root.Sequence()
+
+	return WriteChanges(file, o, func(add func(c Change) error) error {
+		return root.ForEach(func(bucketName, v []byte) error {
+			if v != nil {
+				// changelogID
+				return nil
+			}
+
+			return root.Bucket(bucketName).ForEach(func(k, g []byte) error {
+				if kind == BackupIncremental && Btou64(g) != gen {
+					return nil
+				}
+
+				c, err := change(bucketName, k)
+				if err != nil {
+					return err
+				}
+
+				return add(c)
+			})
+		})
+	})
+}
+
+// NextGeneration moves the changelog to its next generation
+func NextGeneration(t *bolt.Tx) error {
+	root := t.Bucket(ChangesBucket)
+	return root.SetSequence(root.Sequence() + 1)
+}
@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BackupOptions selects how backups are written. Encoded backups start with a header naming what
+// was applied, so readers detect and reverse it; backups without options stay plain files.
+type BackupOptions struct {
+	Compress bool   // gzip
+	Level    int    // gzip level, gzip.DefaultCompression when 0
+	Key      []byte // AES-GCM key of 16, 24 or 32 bytes, nil for no encryption
+}
+
+// Validate checks the gzip level and the key length
+func (o BackupOptions) Validate() error {
+	if o.Compress && (o.Level < gzip.HuffmanOnly || o.Level > gzip.BestCompression) {
+		return fmt.Errorf("backup: invalid gzip level %d", o.Level)
+	}
+
+	if o.Key == nil {
+		return nil
+	}
+
+	_, err := aes.NewCipher(o.Key)
+	return err
+}
+
+func (o BackupOptions) enabled() bool {
+	return o.Compress || o.Key != nil
+}
+
+// Encoded backup layout: magic, version, flags, a random salt when encrypted, then the gzip stream,
+// itself cut into sealed chunks when encrypted. Every chunk is a 4 byte length, high bit set on the
+// last one, and the sealed chunk. Chunks are sealed under a key derived from the backup key and the
+// salt, so every file has its own key and the chunk counter alone is a safe nonce. The file header and
+// the length are the additional data of every chunk, so a changed header or a cut is detected.
+var codecMagic = []byte("MYDB")
+
+const (
+	codecVersion   = 1
+	flagCompressed = 1 << 0
+	flagEncrypted  = 1 << 1
+	chunkSize      = 64 * 1024
+	chunkFinal     = 1 << 31
+	saltSize       = 32
+)
+
+// keyInfo binds derived keys to their use
+var keyInfo = []byte("mydb backup chunks")
+
+// NewBackupWriter returns a writer encoding what is written to w as o asks, Close flushes it
+// without closing w. With no options it writes to w as is.
+func NewBackupWriter(w io.Writer, o BackupOptions) (io.WriteCloser, error) {
+	if !o.enabled() {
+		return nopWriteCloser{w}, nil
+	}
+
+	header := append([]byte{}, codecMagic...)
+	header = append(header, codecVersion, 0)
+
+	bw := &backupWriter{}
+	var sink io.Writer = w
+
+	// Flags first, every chunk authenticates the header
+	if o.Key != nil {
+		header[5] |= flagEncrypted
+	}
+
+	if o.Compress {
+		header[5] |= flagCompressed
+	}
+
+	if o.Key != nil {
+		salt := make([]byte, saltSize)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		header = append(header, salt...)
+
+		aead, err := newAEAD(o.Key, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		bw.chunks = &chunkWriter{w: w, aead: aead, header: header}
+		sink = bw.chunks
+	}
+
+	if o.Compress {
+		level := o.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		gz, err := gzip.NewWriterLevel(sink, level)
+		if err != nil {
+			return nil, err
+		}
+
+		bw.gz = gz
+		sink = gz
+	}
+
+	_, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	bw.out = sink
+	return bw, nil
+}
+
+// NewBackupReader returns a reader reversing what NewBackupWriter applied, key is needed for
+// encrypted backups. Anything without the header is read as is.
+func NewBackupReader(r io.Reader, key []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(codecMagic))
+	if err != nil || !bytes.Equal(magic, codecMagic) {
+		return br, nil
+	}
+
+	header := make([]byte, len(codecMagic)+2)
+	_, err = io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[4] != codecVersion {
+		return nil, fmt.Errorf("backup: unknown encoding version %d", header[4])
+	}
+
+	flags := header[5]
+
+	var src io.Reader = br
+	if flags&flagEncrypted != 0 {
+		if key == nil {
+			return nil, fmt.Errorf("backup: encrypted: %w", ErrBackupKey)
+		}
+
+		salt := make([]byte, saltSize)
+		_, err = io.ReadFull(br, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newAEAD(key, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		src = &chunkReader{r: br, aead: aead, header: append(header, salt...)}
+	}
+
+	if flags&flagCompressed != 0 {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+
+		src = gz
+	}
+
+	return src, nil
+}
+
+// IsEncoded reports whether a backup file starts with the header of an encoded backup
+func IsEncoded(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(codecMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(magic, codecMagic), nil
+}
+
+// EncodeFile encodes a backup file in place as o asks
+func EncodeFile(file string, o BackupOptions) error {
+	if !o.enabled() {
+		return nil
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := file + ".tmp"
+	err = writeFile(tmp, func(out io.Writer) error {
+		w, err := NewBackupWriter(out, o)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, in)
+		if err != nil {
+			return err
+		}
+
+		return w.Close()
+	})
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// DecodeFile writes the decoded content of a backup file to dst, plain files are copied as they are
+func DecodeFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := NewBackupReader(in, key)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(dst, func(out io.Writer) error {
+		_, err := io.Copy(out, r)
+		return err
+	})
+}
+
+func writeFile(file string, write func(w io.Writer) error) error {
+	out, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = write(out)
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// newAEAD returns AES-GCM under the key of one file, derived from key and its salt
+func newAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, salt, keyInfo))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// deriveKey is HKDF-SHA256 (RFC 5869) returning a key of len(key) bytes, at most 32
+func deriveKey(key, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+
+	return expand.Sum(nil)[:len(key)]
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type backupWriter struct {
+	out    io.Writer
+	gz     *gzip.Writer
+	chunks *chunkWriter
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	return w.out.Write(p)
+}
+
+func (w *backupWriter) Close() error {
+	if w.gz != nil {
+		err := w.gz.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.chunks != nil {
+		return w.chunks.Close()
+	}
+
+	return nil
+}
+
+// chunkWriter seals every chunkSize bytes, Close seals the rest as the final chunk
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte // file header, authenticated with every chunk
+	counter uint64
+	buf     []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		free := chunkSize - len(c.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+
+		c.buf = append(c.buf, p[:free]...)
+		p = p[free:]
+
+		if len(c.buf) == chunkSize {
+			err := c.seal(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (c *chunkWriter) Close() error {
+	return c.seal(true)
+}
+
+func (c *chunkWriter) seal(final bool) error {
+	size := uint32(len(c.buf) + c.aead.Overhead())
+	if final {
+		size |= chunkFinal
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, size)
+
+	sealed := c.aead.Seal(header, chunkNonce(c.aead, c.counter), c.buf, chunkData(c.header, header))
+	c.counter++
+	c.buf = c.buf[:0]
+
+	_, err := c.w.Write(sealed)
+	return err
+}
+
+// chunkReader opens the chunks of a chunkWriter in order and fails when the final one is missing
+type chunkReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	buf     []byte
+	final   bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.final {
+			return 0, io.EOF
+		}
+
+		err := c.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+func (c *chunkReader) open() error {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(c.r, header)
+	if err != nil {
+		return fmt.Errorf("backup: truncated: %w", unexpected(err))
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	final := size&chunkFinal != 0
+	size &^= chunkFinal
+
+	if size > chunkSize+uint32(c.aead.Overhead()) {
+		return fmt.Errorf("backup: chunk of %d bytes", size)
+	}
+
+	sealed := make([]byte, size)
+	_, err = io.ReadFull(c.r, sealed)
+	if err != nil {
+		return fmt.Errorf("backup: truncated: %w", unexpected(err))
+	}
+
+	c.buf, err = c.aead.Open(sealed[:0], chunkNonce(c.aead, c.counter), sealed, chunkData(c.header, header))
+	if err != nil {
+		return fmt.Errorf("backup: chunk %d: %w", c.counter, ErrBackupKey)
+	}
+
+	c.counter++
+	c.final = final
+
+	return nil
+}
+
+// chunkNonce is the chunk counter, unique since every file has its own key
+func chunkNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+
+	return nonce
+}
+
+// chunkData is the additional data of a chunk: the file header and the chunk length
+func chunkData(fileHeader, length []byte) []byte {
+	data := make([]byte, 0, len(fileHeader)+len(length))
+	data = append(data, fileHeader...)
+
+	return append(data, length...)
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -1,9 +1,10 @@
 // It is a storage package containing both in-memory and file-type databases that you can use to hold simple data.
 //
-// Use boltdb, sniper and both of them
+// Use boltdb, sniper, memory and both of them
 //
 // All of basic method supported. Add, edit, delete, multi get etc.
 //
 // Via: Boltdb: go.etcd.io/bbolt
 // Via: Sniper: github.com/recoilme/sniper
+// Via: Memory: sorted in-memory buckets, optional boltdb snapshot
 package storage
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"errors"
+)
+
+// Sentinel errors returned by every backend, wrapped with the operation and bucket
+// name they happened on. Match them with errors.Is:
+//
+//	if errors.Is(err, storage.ErrUnknownBucket) { ... }
+var (
+	ErrUnknownBucket  = errors.New("unknown bucket name")
+	ErrReadOnly       = errors.New("readonly mod active")
+	ErrEmptyKey       = errors.New("empty key")
+	ErrEmptyValue     = errors.New("empty value")
+	ErrNotFound       = errors.New("not found")
+	ErrNotImplemented = errors.New("not implemented")
+	ErrBackupKey      = errors.New("backup key missing or wrong")
+	ErrInvalidBucket  = errors.New("invalid bucket name")
+)
+
+// ErrStop is returned by a ForEach callback to stop early, ForEach then returns nil
+var ErrStop = errors.New("stop")
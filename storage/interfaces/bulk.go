@@ -0,0 +1,12 @@
+package interfaces
+
+// BulkLoader streams writes into one bucket and commits them in groups, instead of one transaction per item.
+// A loader is not safe for concurrent use; give each writer its own loader.
+type BulkLoader interface {
+	// Add queues an item, flushing the group once it reaches the loader's batch size
+	Add(k []byte, data []byte) error
+	// Flush commits the queued items
+	Flush() error
+	// Close flushes the queued items, the loader can not be used afterwards
+	Close() error
+}
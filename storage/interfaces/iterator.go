@@ -0,0 +1,21 @@
+package interfaces
+
+// Iterator streams the items of a key range, see Storage.Iterator. It is not safe for concurrent use.
+//
+//	it, err := store.Iterator(bucketName, storage.ScanOptions{})
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	err = it.Err()
+type Iterator interface {
+	// Next moves to the next item, false once there is none left or reading failed
+	Next() bool
+	// Key and Value return the current item, valid until the next call to Next
+	Key() []byte
+	Value() []byte
+	// Err returns the error that stopped the iterator, nil at the end of the range
+	Err() error
+	// Close stops the iterator, Next returns false afterwards
+	Close() error
+}
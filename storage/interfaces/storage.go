@@ -1,19 +1,60 @@
 package interfaces
 
+import (
+	"io"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+)
+
+// Storage is the contract shared by every backend (boltdbstorage, sniperstorage, memorystorage).
+// Services should depend on this type instead of a concrete store package.
 type Storage interface {
-	CloseStore()
+	CloseStore() error
 	SyncStore()
 
 	Set(bucketName []byte, k []byte, data []byte) ([]byte, error)
 	Get(bucketName []byte, k []byte) ([]byte, error)
-	MGet(bucketName []byte, keys ...[]byte) (interface{}, error)
+
+	// SetWithTTL writes a key expiring after ttl, reads hide it once expired. Set clears a previous ttl.
+	// TTL returns the time left, 0 for a key without expiry and storage.ErrNotFound for a missing key.
+	SetWithTTL(bucketName []byte, k []byte, data []byte, ttl time.Duration) ([]byte, error)
+	TTL(bucketName []byte, k []byte) (time.Duration, error)
+
+	MGet(bucketName []byte, keys ...[]byte) (map[string]interface{}, error)
 	List(bucketName []byte, cursor []byte, perpage int) ([]string, error)
 	PrevList(bucketName []byte, cursor []byte, perpage int) ([]string, error)
+
+	// Scan returns the items of the key range o selects, in key order or reversed
+	Scan(bucketName []byte, o storage.ScanOptions) ([]storage.KV, error)
+
+	// Iterator and ForEach stream the items with bounded memory, reading a batch per transaction.
+	// ForEach walks the whole bucket in key order, fn returning storage.ErrStop stops it early.
+	Iterator(bucketName []byte, o storage.ScanOptions) (Iterator, error)
+	ForEach(bucketName []byte, fn func(k, v []byte) error) error
+
 	Delete(bucketName []byte, k []byte) error
 
+	// MSet writes all items in one transaction, BulkLoader streams many items in groups of size.
+	MSet(bucketName []byte, items map[string][]byte) error
+	BulkLoader(bucketName []byte, size int) (BulkLoader, error)
+
+	// Update runs fn in a read-write transaction, committed when fn returns nil and rolled back otherwise.
+	// View runs fn in a read-only transaction. Do not call other Storage methods from fn.
+	Update(fn func(tx Tx) error) error
+	View(fn func(tx Tx) error) error
+
 	KeyExist(bucketName []byte, k []byte) (bool, error)
 	ValueExist(bucketName []byte, v []byte) (bool, error)
 
+	// KeysByValue returns the keys of a bucket holding v, sorted
+	KeysByValue(bucketName []byte, v []byte) ([]string, error)
+
+	// CreateBucket and CreateIndex add a bucket or an index at runtime, kept by the store so reopening
+	// it finds them without listing them in NewStore again. Creating an existing one does nothing.
+	CreateBucket(bucketName []byte) error
+	CreateIndex(indexName []byte) error
+
 	HasBucket(bucketName []byte) bool
 	StatsBucket(bucketName []byte) int
 	ListBucket() ([]string, error)
@@ -21,4 +62,6 @@ type Storage interface {
 
 	Backup(path, filename string) error
 	Restore(path, filename string) error
+	BackupTo(w io.Writer) error
+	RestoreFrom(r io.Reader) error
 }
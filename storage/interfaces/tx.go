@@ -0,0 +1,19 @@
+package interfaces
+
+// Tx is a transaction spanning every bucket of a Storage, handed to Storage.Update and Storage.View.
+// Values returned by Get and Cursor are only valid until the transaction ends.
+type Tx interface {
+	Get(bucketName []byte, k []byte) ([]byte, error)
+	Set(bucketName []byte, k []byte, data []byte) ([]byte, error)
+	Delete(bucketName []byte, k []byte) error
+	Cursor(bucketName []byte) (Cursor, error)
+}
+
+// Cursor walks the keys of a bucket in order, like a bolt cursor. A nil key means the cursor moved past either end.
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+}
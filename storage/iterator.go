@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+)
+
+// IteratorBatch is the number of items an iterator reads per transaction
+const IteratorBatch = 1000
+
+// Item is a key and its value, both owned by the holder
+type Item struct {
+	Key   []byte
+	Value []byte
+}
+
+// BatchIterator streams the items of a key range in batches read by page, each in its own transaction. No
+// transaction stays open between batches: the next one starts after the last key read, so writes made while
+// iterating show up once they are past it.
+type BatchIterator struct {
+	o     ScanOptions
+	size  int
+	page  func(o ScanOptions) ([]Item, error)
+	items []Item
+	item  Item
+	last  []byte
+	taken int
+	more  bool
+	err   error
+}
+
+// NewBatchIterator returns an iterator over the range of o, page returns up to o.Limit items of a range
+func NewBatchIterator(o ScanOptions, size int, page func(o ScanOptions) ([]Item, error)) *BatchIterator {
+	if size < 1 {
+		size = IteratorBatch
+	}
+
+	return &BatchIterator{o: o, size: size, page: page, more: true}
+}
+
+func (it *BatchIterator) Next() bool {
+	if it.o.Limit > 0 && it.taken >= it.o.Limit {
+		it.more = false
+	}
+
+	if len(it.items) == 0 && it.more {
+		it.fetch()
+	}
+
+	if len(it.items) == 0 {
+		it.item = Item{}
+		return false
+	}
+
+	it.item, it.items = it.items[0], it.items[1:]
+	it.taken++
+
+	return true
+}
+
+// fetch reads the batch after the last key read
+func (it *BatchIterator) fetch() {
+	o := it.o
+	o.Limit = it.size
+	if it.o.Limit > 0 && it.o.Limit-it.taken < o.Limit {
+		o.Limit = it.o.Limit - it.taken
+	}
+
+	if it.last != nil && o.Reverse {
+		o.End, o.Inclusive = it.last, false
+	} else if it.last != nil {
+		// The first key after last
+		o.Start = append(append([]byte{}, it.last...), 0)
+	}
+
+	items, err := it.page(o)
+	if err != nil {
+		it.err, it.more = err, false
+		return
+	}
+
+	it.items = items
+	it.more = len(items) == o.Limit
+	if len(items) > 0 {
+		it.last = items[len(items)-1].Key
+	}
+}
+
+func (it *BatchIterator) Key() []byte {
+	return it.item.Key
+}
+
+func (it *BatchIterator) Value() []byte {
+	return it.item.Value
+}
+
+func (it *BatchIterator) Err() error {
+	return it.err
+}
+
+func (it *BatchIterator) Close() error {
+	it.items, it.item, it.more = nil, Item{}, false
+	return nil
+}
+
+// ForEach calls fn with every item left until fn fails, then closes the iterator.
+// fn returning ErrStop stops early without error.
+func (it *BatchIterator) ForEach(fn func(k, v []byte) error) error {
+	defer it.Close()
+
+	for it.Next() {
+		err := fn(it.Key(), it.Value())
+		if errors.Is(err, ErrStop) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BackupVersion is the manifest format written by NewBackupManifest
+const BackupVersion = 1
+
+// BackupManifest is written next to a backup as filename.manifest. Buckets and ContentHash describe the
+// declared buckets of the bolt file of the backup, Files maps every backup file to its sha256 as stored,
+// after compression and encryption.
+type BackupManifest struct {
+	Version     int               `json:"version"`
+	Backend     string            `json:"backend"`
+	Created     time.Time         `json:"created"`
+	Bolt        string            `json:"bolt"`
+	Buckets     map[string]int    `json:"buckets"`
+	ContentHash string            `json:"content_hash"`
+	Files       map[string]string `json:"files"`
+	Compressed  bool              `json:"compressed,omitempty"`
+	Encrypted   bool              `json:"encrypted,omitempty"`
+}
+
+// NewBackupManifest describes the backup files in dir, boltFile is the one holding the buckets
+func NewBackupManifest(backend, dir, boltFile string, buckets []string, files ...string) (*BackupManifest, error) {
+	m := &BackupManifest{
+		Version: BackupVersion,
+		Backend: backend,
+		Created: time.Now().UTC(),
+		Bolt:    boltFile,
+		Files:   map[string]string{},
+	}
+
+	var err error
+	m.Buckets, m.ContentHash, err = boltContent(filepath.Join(dir, boltFile), buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		m.Files[file], err = FileChecksum(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Encode compresses and encrypts the backup files in dir as o asks and records their new checksums
+func (m *BackupManifest) Encode(dir string, o BackupOptions) error {
+	if !o.enabled() {
+		return nil
+	}
+
+	for file := range m.Files {
+		err := EncodeFile(filepath.Join(dir, file), o)
+		if err != nil {
+			return err
+		}
+
+		m.Files[file], err = FileChecksum(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+	}
+
+	m.Compressed = o.Compress
+	m.Encrypted = o.Key != nil
+
+	return nil
+}
+
+// ManifestFile returns the manifest path of the backup filename in path
+func ManifestFile(path, filename string) string {
+	return strings.TrimSuffix(path, "/") + "/" + filename + ".manifest"
+}
+
+// WriteManifest writes any manifest (a BackupManifest or a backend's extension of it) as JSON
+func WriteManifest(file string, m interface{}) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, data, 0600)
+}
+
+// ReadManifest reads a manifest written by WriteManifest into m
+func ReadManifest(file string, m interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, m)
+}
+
+// VerifyBackup checks the backup filename in path against its manifest: the sha256 of every file,
+// bolt's consistency check on the bolt file and its key counts and content hash.
+// Encrypted backups need VerifyBackupWithKey.
+func VerifyBackup(path, filename string) error {
+	return VerifyBackupWithKey(path, filename, nil)
+}
+
+// VerifyBackupWithKey is VerifyBackup for backups encrypted with key
+func VerifyBackupWithKey(path, filename string, key []byte) error {
+	m := &BackupManifest{}
+
+	err := ReadManifest(ManifestFile(path, filename), m)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", filename, err)
+	}
+
+	if m.Version != BackupVersion {
+		return fmt.Errorf("verify %s: unknown manifest version %d", filename, m.Version)
+	}
+
+	for file, want := range m.Files {
+		sum, err := FileChecksum(filepath.Join(path, file))
+		if err != nil {
+			return fmt.Errorf("verify %s: %w", filename, err)
+		}
+
+		if sum != want {
+			return fmt.Errorf("verify %s: %s checksum mismatch", filename, file)
+		}
+	}
+
+	buckets := make([]string, 0, len(m.Buckets))
+	for name := range m.Buckets {
+		buckets = append(buckets, name)
+	}
+
+	boltFile := filepath.Join(path, m.Bolt)
+	if m.Compressed || m.Encrypted {
+		tmp, err := os.CreateTemp("", "mydb-")
+		if err != nil {
+			return err
+		}
+
+		_ = tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		err = DecodeFile(boltFile, tmp.Name(), key)
+		if err != nil {
+			return fmt.Errorf("verify %s: %s: %w", filename, m.Bolt, err)
+		}
+
+		boltFile = tmp.Name()
+	}
+
+	counts, content, err := boltContent(boltFile, buckets)
+	if err != nil {
+		return fmt.Errorf("verify %s: %s: %w", filename, m.Bolt, err)
+	}
+
+	for name, n := range m.Buckets {
+		if counts[name] != n {
+			return fmt.Errorf("verify %s: bucket %s has %d keys, manifest %d", filename, name, counts[name], n)
+		}
+	}
+
+	if content != m.ContentHash {
+		return fmt.Errorf("verify %s: content hash mismatch", filename)
+	}
+
+	return nil
+}
+
+// boltContent runs bolt's consistency check on a bolt file, then counts the keys of the buckets and
+// hashes their content: every bucket by name, then its keys and values in order, all length prefixed.
+func boltContent(file string, buckets []string) (map[string]int, string, error) {
+	err := CheckBoltFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	db, err := bolt.Open(file, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	names := append([]string{}, buckets...)
+	sort.Strings(names)
+
+	counts := map[string]int{}
+	h := sha256.New()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for i, name := range names {
+			if i > 0 && names[i-1] == name {
+				// index buckets are usually declared as buckets too
+				continue
+			}
+
+			counts[name] = 0
+			writeField(h, []byte(name))
+
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+
+			err := b.ForEach(func(k, v []byte) error {
+				counts[name]++
+				writeField(h, k)
+				writeField(h, v)
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return counts, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeField(h hash.Hash, b []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+	h.Write(size[:])
+	h.Write(b)
+}
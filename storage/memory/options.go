@@ -0,0 +1,35 @@
+package memorystorage
+
+import (
+	"time"
+)
+
+// Option configures a Store in NewStore
+type Option func(*Store) error
+
+// ExpireInterval starts a background sweeper deleting expired keys every interval, default 0 (disabled).
+// Expired keys are hidden from reads either way.
+func ExpireInterval(interval time.Duration) Option {
+	return func(s *Store) error {
+		s.expireInterval = interval
+		return nil
+	}
+}
+
+// CompressBackups gzips every backup at level, gzip.DefaultCompression for 0. Restore detects it.
+func CompressBackups(level int) Option {
+	return func(s *Store) error {
+		s.backupOptions.Compress = true
+		s.backupOptions.Level = level
+		return s.backupOptions.Validate()
+	}
+}
+
+// EncryptBackups encrypts every backup with AES-GCM under key (16, 24 or 32 bytes).
+// Restore detects it and needs the same key.
+func EncryptBackups(key []byte) Option {
+	return func(s *Store) error {
+		s.backupOptions.Key = key
+		return s.backupOptions.Validate()
+	}
+}
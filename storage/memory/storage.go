@@ -0,0 +1,831 @@
+package memorystorage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ interfaces.Storage = (*Store)(nil)
+
+// backend names the archives of this store, archiveName is the Backup filename inside them
+const (
+	backend     = "memory"
+	archiveName = "snapshot"
+)
+
+// Index: none, keys are kept sorted in memory
+// Database: memory - snapshot to a boltdb file on SyncStore/CloseStore when path is set
+type Store struct {
+	mu       sync.RWMutex
+	buckets  map[string]*bucket
+	path     string
+	snapshot string
+	registry *storage.Registry
+	readOnly bool
+
+	expireInterval time.Duration
+	sweeperStop    chan struct{}
+	sweeperDone    chan struct{}
+
+	backupOptions storage.BackupOptions
+}
+
+// bucket holds its keys sorted so List/PrevList can walk them like a bolt cursor. Single writes insert
+// in place, bulk ones merge or filter the keys once.
+type bucket struct {
+	keys     []string
+	values   map[string][]byte
+	expires  map[string]int64
+	sequence uint64
+}
+
+func newBucket() *bucket {
+	return &bucket{values: make(map[string][]byte), expires: make(map[string]int64)}
+}
+
+// seek returns the position of the first key >= k
+func (b *bucket) seek(k []byte) int {
+	return sort.SearchStrings(b.keys, string(k))
+}
+
+// get returns nil for missing and expired keys
+func (b *bucket) get(k []byte) []byte {
+	if b.expired(string(k)) {
+		return nil
+	}
+
+	return b.values[string(k)]
+}
+
+func (b *bucket) expired(key string) bool {
+	expire, ok := b.expires[key]
+
+	return ok && expire <= time.Now().UnixNano()
+}
+
+func (b *bucket) put(k, v []byte) {
+	key := string(k)
+	if _, ok := b.values[key]; !ok {
+		i := b.seek(k)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+
+	b.values[key] = append([]byte{}, v...)
+	delete(b.expires, key)
+}
+
+func (b *bucket) delete(k []byte) {
+	key := string(k)
+	if _, ok := b.values[key]; !ok {
+		return
+	}
+
+	i := b.seek(k)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.values, key)
+	delete(b.expires, key)
+}
+
+// putAll writes items like put, the new keys are sorted once and merged into keys in one pass
+func (b *bucket) putAll(items map[string][]byte) {
+	added := []string{}
+	for key, v := range items {
+		if _, ok := b.values[key]; !ok {
+			added = append(added, key)
+		}
+
+		b.values[key] = append([]byte{}, v...)
+		delete(b.expires, key)
+	}
+
+	if len(added) == 0 {
+		return
+	}
+
+	sort.Strings(added)
+
+	keys := make([]string, 0, len(b.keys)+len(added))
+	i := 0
+	for _, key := range added {
+		for i < len(b.keys) && b.keys[i] < key {
+			keys = append(keys, b.keys[i])
+			i++
+		}
+
+		keys = append(keys, key)
+	}
+
+	b.keys = append(keys, b.keys[i:]...)
+}
+
+// deleteAll deletes the keys drop reports, keys is filtered in one pass
+func (b *bucket) deleteAll(drop func(key string) bool) {
+	keys := b.keys[:0]
+	for _, key := range b.keys {
+		if !drop(key) {
+			keys = append(keys, key)
+			continue
+		}
+
+		delete(b.values, key)
+		delete(b.expires, key)
+	}
+
+	b.keys = keys
+}
+
+// NewStore opens an in-memory store. With an empty path nothing touches the filesystem,
+// otherwise "<path><dbName>.db" is loaded on open and written back on SyncStore/CloseStore.
+// The snapshot is a plain boltdb file, so boltdbstorage can open it too. It keeps the buckets created
+// with CreateBucket and CreateIndex as well.
+func NewStore(bucketList, indexList []string, path string, dbName string, readOnly bool, opts ...Option) (*Store, error) {
+	s := &Store{}
+	s.readOnly = readOnly
+	s.registry = storage.NewRegistry(bucketList, indexList)
+
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	s.buckets = make(map[string]*bucket)
+	for _, bucketName := range s.registry.All() {
+		s.buckets[bucketName] = newBucket()
+	}
+
+	if len(path) > 0 {
+		s.path = path
+		s.snapshot = fmt.Sprintf("%s%s.db", path, dbName)
+
+		_, err := os.Stat(s.snapshot)
+		if err == nil {
+			err = s.load(s.snapshot)
+		}
+
+		if err != nil && !os.IsNotExist(err) {
+			return s, err
+		}
+	}
+
+	if s.expireInterval > 0 && !readOnly {
+		s.sweeperStop = make(chan struct{})
+		s.sweeperDone = make(chan struct{})
+		go s.sweep()
+	}
+
+	return s, nil
+}
+
+func (s *Store) CloseStore() error {
+	if s.sweeperStop != nil {
+		close(s.sweeperStop)
+		<-s.sweeperDone
+		s.sweeperStop = nil
+	}
+
+	return s.sync()
+}
+
+func (s *Store) SyncStore() {
+	_ = s.sync()
+}
+
+// sync writes the snapshot file, if any
+func (s *Store) sync() error {
+	if s.readOnly || len(s.snapshot) == 0 {
+		return nil
+	}
+
+	// Create dir if not exist
+	_ = storage.CreateDir(s.path)
+
+	return s.save(s.snapshot)
+}
+
+func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
+	return s.set(bucketName, k, v, 0)
+}
+
+// set writes a key expiring at expire (unix nano), 0 for no expiry
+func (s *Store) set(bucketName []byte, k []byte, v []byte, expire int64) ([]byte, error) {
+	if s.readOnly {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(v) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyValue)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.buckets[string(bucketName)]
+
+	if len(k) == 0 {
+		b.sequence++
+		k = storage.U64tob(int(b.sequence))
+	}
+
+	b.put(k, v)
+	if expire > 0 {
+		b.expires[string(k)] = expire
+	}
+
+	return k, nil
+}
+
+func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("get %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rxData := s.buckets[string(bucketName)].get(k)
+	if rxData == nil {
+		return nil, nil
+	}
+
+	return append([]byte{}, rxData...), nil
+}
+
+func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("mget %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.buckets[string(bucketName)]
+	items := make(map[string]interface{})
+
+	for index, key := range keys {
+		items[fmt.Sprintf("%d:%s", index, key)] = string(b.get(key))
+	}
+
+	return items, nil
+}
+
+func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, err error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("list %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.buckets[string(bucketName)]
+	items := []string{}
+
+	i := 0
+	if len(k) > 0 {
+		i = b.seek(k)
+		if i < len(b.keys) && b.keys[i] == string(k) {
+			i++
+		}
+	}
+
+	for ; i < len(b.keys); i++ {
+		if b.expired(b.keys[i]) {
+			continue
+		}
+
+		items = append(items, s.item(bucketName, b, b.keys[i]))
+
+		if len(items) >= perpage {
+			break
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return items, nil
+}
+
+func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("prevlist %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.buckets[string(bucketName)]
+	items := []string{}
+
+	// First key < cursor, or the last key without cursor
+	i := len(b.keys) - 1
+	if len(k) > 0 {
+		i = b.seek(k) - 1
+	}
+
+	for ; i >= 0; i-- {
+		if b.expired(b.keys[i]) {
+			continue
+		}
+
+		items = append(items, s.item(bucketName, b, b.keys[i]))
+
+		if len(items) >= perpage {
+			break
+		}
+	}
+
+	return items, nil
+}
+
+// item returns a list entry the way boltdbstorage does: storage.KV for index buckets, raw value otherwise
+func (s *Store) item(bucketName []byte, b *bucket, key string) string {
+	if !s.registry.IsIndex(bucketName) {
+		return string(b.values[key])
+	}
+
+	kv := storage.KV{
+		Key:   key,
+		Value: string(b.values[key]),
+	}
+	v, _ := kv.MarshalBinary()
+
+	return string(v)
+}
+
+// Scan returns the items of the key range o selects (see storage.ScanOptions)
+func (s *Store) Scan(bucketName []byte, o storage.ScanOptions) ([]storage.KV, error) {
+	items := []storage.KV{}
+	err := s.scan("scan", bucketName, o, func(k, v []byte) {
+		items = append(items, storage.KV{Key: string(k), Value: string(v)})
+	})
+
+	return items, err
+}
+
+// Iterator streams the items of the key range o selects, storage.IteratorBatch items per transaction
+func (s *Store) Iterator(bucketName []byte, o storage.ScanOptions) (interfaces.Iterator, error) {
+	return s.iterator("iterator", bucketName, o)
+}
+
+// ForEach calls fn with every item of bucketName in key order until fn fails, outside any transaction so
+// fn can use the store. fn returning storage.ErrStop stops early without error.
+func (s *Store) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	it, err := s.iterator("foreach", bucketName, storage.ScanOptions{})
+	if err != nil {
+		return err
+	}
+
+	return it.ForEach(fn)
+}
+
+func (s *Store) iterator(op string, bucketName []byte, o storage.ScanOptions) (*storage.BatchIterator, error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	return storage.NewBatchIterator(o, storage.IteratorBatch, func(o storage.ScanOptions) ([]storage.Item, error) {
+		items := []storage.Item{}
+		err := s.scan(op, bucketName, o, func(k, v []byte) {
+			items = append(items, storage.Item{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+		})
+
+		return items, err
+	}), nil
+}
+
+// scan calls fn with the items of the range o selects, skipping expired keys
+func (s *Store) scan(op string, bucketName []byte, o storage.ScanOptions, fn func(k, v []byte)) error {
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.buckets[string(bucketName)]
+
+	return o.Walk(&cursor{b: b}, func(k, v []byte) (bool, error) {
+		if b.expired(string(k)) {
+			return false, nil
+		}
+
+		fn(k, v)
+		return true, nil
+	})
+}
+
+func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
+	if !s.registry.Has(bucketName) {
+		return false, fmt.Errorf("keyexist %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.buckets[string(bucketName)].get(k) != nil, nil
+}
+
+func (s *Store) ValueExist(bucketName []byte, v []byte) (bool, error) {
+	if !s.registry.Has(bucketName) {
+		return false, fmt.Errorf("valueexist %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.buckets[string(bucketName)]
+	for key, value := range b.values {
+		if bytes.Equal(value, v) && !b.expired(key) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Store) KeysByValue(bucketName []byte, v []byte) ([]string, error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("keysbyvalue %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	b := s.buckets[string(bucketName)]
+	for key, value := range b.values {
+		if bytes.Equal(value, v) && !b.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *Store) Delete(bucketName []byte, k []byte) error {
+	if s.readOnly {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrEmptyKey)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets[string(bucketName)].delete(k)
+
+	return nil
+}
+
+// CreateBucket adds a bucket at runtime, kept in the snapshot for the next NewStore.
+// Creating a bucket that already exists does nothing.
+func (s *Store) CreateBucket(bucketName []byte) error {
+	return s.create("createbucket", bucketName, storage.KindBucket)
+}
+
+// CreateIndex adds an index at runtime like CreateBucket
+func (s *Store) CreateIndex(indexName []byte) error {
+	return s.create("createindex", indexName, storage.KindIndex)
+}
+
+func (s *Store) create(op string, name []byte, kind storage.BucketKind) error {
+	if s.readOnly {
+		return fmt.Errorf("%s %s: %w", op, name, storage.ErrReadOnly)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.registry.Check(name)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", op, name, err)
+	}
+
+	// The bucket exists before the registry lets calls in
+	if _, ok := s.buckets[string(name)]; !ok {
+		s.buckets[string(name)] = newBucket()
+	}
+
+	s.registry.Add(name, kind)
+	return nil
+}
+
+func (s *Store) HasBucket(bucketName []byte) bool {
+	return s.registry.Has(bucketName)
+}
+
+func (s *Store) StatsBucket(bucketName []byte) int {
+	if !s.registry.Has(bucketName) {
+		return 0
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.buckets[string(bucketName)].keys)
+}
+
+func (s *Store) ListBucket() (buckets []string, err error) {
+	return s.registry.Buckets(), nil
+}
+
+func (s *Store) DeleteBucket(bucketName []byte) error {
+	if s.readOnly {
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets[string(bucketName)] = newBucket()
+
+	return nil
+}
+
+// Backup writes a boltdb file, the same "<path>/<filename>.backup" boltdbstorage.Backup writes
+func (s *Store) Backup(path, filename string) error {
+	// Create dir if necessary
+	_ = storage.CreateDir(path)
+
+	file := strings.TrimSuffix(path, "/") + "/" + filename + ".backup"
+
+	err := s.save(file)
+	if err != nil {
+		return err
+	}
+
+	return storage.EncodeFile(file, s.backupOptions)
+}
+
+// Restore replaces all buckets with the content of a backup written by Backup (or boltdbstorage.Backup)
+func (s *Store) Restore(path, filename string) error {
+	if s.readOnly {
+		return fmt.Errorf("restore: %w", storage.ErrReadOnly)
+	}
+
+	file := strings.TrimSuffix(path, "/") + "/" + filename + ".backup"
+
+	encoded, err := storage.IsEncoded(file)
+	if err != nil {
+		return err
+	}
+
+	if encoded {
+		tmp, err := os.CreateTemp("", "mydb-")
+		if err != nil {
+			return err
+		}
+
+		_ = tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		err = storage.DecodeFile(file, tmp.Name(), s.backupOptions.Key)
+		if err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+
+		file = tmp.Name()
+	}
+
+	return s.load(file)
+}
+
+// BackupTo streams a backup archive (see storage.ArchiveWriter) of all buckets to w, compressed and
+// encrypted as a whole as the backup options ask
+func (s *Store) BackupTo(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "mydb-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	err = s.save(dir + "/" + archiveName + ".backup")
+	if err != nil {
+		return err
+	}
+
+	bw, err := storage.NewBackupWriter(w, s.backupOptions)
+	if err != nil {
+		return err
+	}
+
+	a, err := storage.NewArchiveWriter(bw, backend, archiveName+".backup")
+	if err != nil {
+		return err
+	}
+
+	err = a.AddFile(archiveName+".backup", dir+"/"+archiveName+".backup")
+	if err != nil {
+		return err
+	}
+
+	err = a.Close()
+	if err != nil {
+		return err
+	}
+
+	return bw.Close()
+}
+
+// RestoreFrom reads an archive written by BackupTo (or boltdbstorage.BackupTo) and restores it like Restore
+func (s *Store) RestoreFrom(r io.Reader) error {
+	if s.readOnly {
+		return fmt.Errorf("restorefrom: %w", storage.ErrReadOnly)
+	}
+
+	dir, err := os.MkdirTemp("", "mydb-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	r, err = storage.NewBackupReader(r, s.backupOptions.Key)
+	if err != nil {
+		return fmt.Errorf("restorefrom: %w", err)
+	}
+
+	m, err := storage.ReadArchive(r, dir)
+	if err != nil {
+		return fmt.Errorf("restorefrom: %w", err)
+	}
+
+	if m.Backend != backend && m.Backend != "boltdb" {
+		return fmt.Errorf("restorefrom: archive of %s, not %s", m.Backend, backend)
+	}
+
+	return s.Restore(dir, archiveName)
+}
+
+// save writes every bucket to a boltdb file, replacing it only once the write succeeded
+func (s *Store) save(file string) error {
+	tmp := file + ".tmp"
+	_ = os.Remove(tmp)
+
+	db, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	err = db.Update(func(t *bolt.Tx) error {
+		err := s.registry.Save(t)
+		if err != nil {
+			return err
+		}
+
+		for name, mb := range s.buckets {
+			b, err := t.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for _, key := range mb.keys {
+				err = b.Put([]byte(key), mb.values[key])
+				if err != nil {
+					return err
+				}
+			}
+
+			err = b.SetSequence(mb.sequence)
+			if err != nil {
+				return err
+			}
+
+			if len(mb.expires) == 0 {
+				continue
+			}
+
+			// Same layout boltdbstorage keeps expiries in
+			root, err := t.CreateBucketIfNotExists(ttlBucket)
+			if err != nil {
+				return err
+			}
+
+			tb, err := root.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for key, expire := range mb.expires {
+				err = tb.Put([]byte(key), storage.U64tob(int(expire)))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	s.mu.RUnlock()
+
+	if err == nil {
+		err = db.Close()
+	} else {
+		_ = db.Close()
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// load replaces every bucket of the store and the ones the file registered with their content in
+// a boltdb file
+func (s *Store) load(file string) error {
+	db, err := bolt.Open(file, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	registry := storage.NewRegistry(nil, nil)
+	registry.Reset(s.registry)
+
+	buckets := make(map[string]*bucket)
+	err = db.View(func(t *bolt.Tx) error {
+		err := registry.Load(t)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range registry.All() {
+			mb := newBucket()
+			buckets[name] = mb
+
+			b := t.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+
+			mb.sequence = b.Sequence()
+			err := b.ForEach(func(k, v []byte) error {
+				// keys arrive sorted
+				mb.keys = append(mb.keys, string(k))
+				mb.values[string(k)] = append([]byte{}, v...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if root := t.Bucket(ttlBucket); root != nil && root.Bucket([]byte(name)) != nil {
+				err = root.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+					mb.expires[string(k)] = int64(storage.Btou64(v))
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.buckets = buckets
+	s.mu.Unlock()
+
+	// Only once the buckets exist
+	s.registry.Reset(registry)
+
+	return nil
+}
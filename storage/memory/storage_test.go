@@ -0,0 +1,115 @@
+package memorystorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+	boltdbstorage "github.com/uretgec/mydb/storage/boltdb"
+	"github.com/uretgec/mydb/storage/interfaces"
+	"github.com/uretgec/mydb/storage/storagetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCmd(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Nothing written without a path
+	_, err = os.Stat("./storage_test.db")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(bucketList, indexList []string, path, dbName string, readOnly bool) (interfaces.Storage, error) {
+		return NewStore(bucketList, indexList, path, dbName, readOnly)
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// The snapshot is a boltdb file
+	bstore, err := boltdbstorage.NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", true)
+	assert.NoError(t, err)
+
+	res, err := bstore.Get([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("number one"), res)
+
+	err = bstore.CloseStore()
+	assert.NoError(t, err)
+}
+
+func OpenStore() (*Store, error) {
+	return NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, "", "storage_test", false)
+}
+
+func TestExpireInterval(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false, ExpireInterval(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), []byte("test_1"), []byte("number one"), time.Second)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	// The sweeper drops the expired key from its bucket
+	assert.Eventually(t, func() bool {
+		return store.StatsBucket([]byte("posts")) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestUpdateRollbackSequence(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	failure := errors.New("failure")
+	err = store.Update(func(tx interfaces.Tx) error {
+		_, err := tx.Set([]byte("posts"), nil, []byte("numbered"))
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+	assert.Equal(t, true, errors.Is(err, failure))
+
+	// Like bolt's NextSequence, the rolled back key is numbered again
+	k, err := store.Set([]byte("posts"), nil, []byte("numbered"))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.U64tob(1), k)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,77 @@
+package memorystorage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+)
+
+// ttlBucket is where snapshots keep expiries, the same layout boltdbstorage uses
+var ttlBucket = []byte("[ttl]")
+
+// SetWithTTL writes like Set, the key expires after ttl
+func (s *Store) SetWithTTL(bucketName []byte, k []byte, v []byte, ttl time.Duration) ([]byte, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("setwithttl %s: invalid ttl %s", bucketName, ttl)
+	}
+
+	return s.set(bucketName, k, v, time.Now().Add(ttl).UnixNano())
+}
+
+// TTL returns the time left before the key expires, 0 for a key without expiry.
+// Missing or expired keys return storage.ErrNotFound.
+func (s *Store) TTL(bucketName []byte, k []byte) (time.Duration, error) {
+	if !s.registry.Has(bucketName) {
+		return 0, fmt.Errorf("ttl %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.buckets[string(bucketName)]
+	if b.get(k) == nil {
+		return 0, fmt.Errorf("ttl %s: %w", bucketName, storage.ErrNotFound)
+	}
+
+	if expire, ok := b.expires[string(k)]; ok {
+		return time.Until(time.Unix(0, expire)), nil
+	}
+
+	return 0, nil
+}
+
+// Expire deletes every expired key, the sweeper started by ExpireInterval calls it
+func (s *Store) Expire() error {
+	if s.readOnly {
+		return fmt.Errorf("expire: %w", storage.ErrReadOnly)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.buckets {
+		if len(b.expires) > 0 {
+			b.deleteAll(b.expired)
+		}
+	}
+
+	return nil
+}
+
+// sweep runs Expire every expireInterval until CloseStore
+func (s *Store) sweep() {
+	defer close(s.sweeperDone)
+
+	ticker := time.NewTicker(s.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.Expire()
+		case <-s.sweeperStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package memorystorage
+
+import (
+	"fmt"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+)
+
+// tx runs under the store lock and keeps an undo log to roll back a failed Update
+type tx struct {
+	s        *Store
+	writable bool
+	undo     []undo
+	seen     map[string]bool
+
+	// sequences holds the bucket sequences at the start, a rollback gives back the keys Set numbered
+	sequences map[string]uint64
+}
+
+// undo is the value a key had before the transaction first wrote it, nil when it did not exist
+type undo struct {
+	bucketName string
+	key        string
+	value      []byte
+	expire     int64
+}
+
+func (s *Store) Update(fn func(tx interfaces.Tx) error) error {
+	if s.readOnly {
+		return fmt.Errorf("update: %w", storage.ErrReadOnly)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := &tx{s: s, writable: true, seen: make(map[string]bool), sequences: make(map[string]uint64, len(s.buckets))}
+	for name, b := range s.buckets {
+		t.sequences[name] = b.sequence
+	}
+
+	err := fn(t)
+	if err != nil {
+		t.rollback()
+	}
+
+	return err
+}
+
+func (s *Store) View(fn func(tx interfaces.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&tx{s: s})
+}
+
+// remember records the current value of a key the first time the transaction writes it
+func (tx *tx) remember(bucketName []byte, k []byte) {
+	id := fmt.Sprintf("%d:%s%s", len(bucketName), bucketName, k)
+	if tx.seen[id] {
+		return
+	}
+
+	b := tx.s.buckets[string(bucketName)]
+
+	tx.seen[id] = true
+	tx.undo = append(tx.undo, undo{
+		bucketName: string(bucketName),
+		key:        string(k),
+		value:      b.get(k),
+		expire:     b.expires[string(k)],
+	})
+}
+
+func (tx *tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		b := tx.s.buckets[u.bucketName]
+
+		if u.value == nil {
+			b.delete([]byte(u.key))
+		} else {
+			b.put([]byte(u.key), u.value)
+			if u.expire > 0 {
+				b.expires[u.key] = u.expire
+			}
+		}
+	}
+
+	for name, sequence := range tx.sequences {
+		tx.s.buckets[name].sequence = sequence
+	}
+}
+
+func (tx *tx) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("get %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	return tx.s.buckets[string(bucketName)].get(k), nil
+}
+
+func (tx *tx) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
+	if !tx.writable {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(v) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyValue)
+	}
+
+	b := tx.s.buckets[string(bucketName)]
+
+	if len(k) == 0 {
+		b.sequence++
+		k = storage.U64tob(int(b.sequence))
+	}
+
+	tx.remember(bucketName, k)
+	b.put(k, v)
+
+	return k, nil
+}
+
+func (tx *tx) Delete(bucketName []byte, k []byte) error {
+	if !tx.writable {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !tx.s.registry.Has(bucketName) {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrEmptyKey)
+	}
+
+	tx.remember(bucketName, k)
+	tx.s.buckets[string(bucketName)].delete(k)
+
+	return nil
+}
+
+func (tx *tx) Cursor(bucketName []byte) (interfaces.Cursor, error) {
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("cursor %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	return &cursor{b: tx.s.buckets[string(bucketName)]}, nil
+}
+
+// cursor remembers its position by key, so writes made while walking do not make it skip keys
+type cursor struct {
+	b   *bucket
+	key string
+}
+
+func (c *cursor) at(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.b.keys) {
+		return nil, nil
+	}
+
+	c.key = c.b.keys[i]
+
+	return []byte(c.key), c.b.values[c.key]
+}
+
+func (c *cursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *cursor) Last() ([]byte, []byte) {
+	return c.at(len(c.b.keys) - 1)
+}
+
+func (c *cursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(c.b.seek(seek))
+}
+
+func (c *cursor) Next() ([]byte, []byte) {
+	i := c.b.seek([]byte(c.key))
+	if i < len(c.b.keys) && c.b.keys[i] == c.key {
+		i++
+	}
+
+	return c.at(i)
+}
+
+func (c *cursor) Prev() ([]byte, []byte) {
+	return c.at(c.b.seek([]byte(c.key)) - 1)
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BucketKind tells plain buckets and index buckets apart, a name can be both like in NewStore's lists
+type BucketKind string
+
+const (
+	KindBucket BucketKind = "bucket"
+	KindIndex  BucketKind = "index"
+)
+
+// RegistryBucket is the bolt root bucket a Registry is kept in: name -> BucketInfo json
+var RegistryBucket = []byte("[buckets]")
+
+// BucketInfo is the catalog record of a bucket
+type BucketInfo struct {
+	Name    string       `json:"-"`
+	Kinds   []BucketKind `json:"kinds"`
+	Created time.Time    `json:"created"`
+	Count   int          `json:"count"` // items, kept by stores that can not count a bucket otherwise (sniperdb)
+}
+
+// Is reports whether the bucket is of kind
+func (b BucketInfo) Is(kind BucketKind) bool {
+	return hasKind(b.Kinds, kind)
+}
+
+// Registry holds the bucket and index names of a store: the ones passed to NewStore and the ones created
+// at runtime. It is safe for concurrent use, every call checks it while CreateBucket adds to it.
+type Registry struct {
+	mu    sync.RWMutex
+	names map[string][]BucketKind
+}
+
+// NewRegistry returns a registry holding bucketList and indexList
+func NewRegistry(bucketList, indexList []string) *Registry {
+	r := &Registry{names: make(map[string][]BucketKind)}
+	for _, name := range bucketList {
+		r.add(name, KindBucket)
+	}
+
+	for _, name := range indexList {
+		r.add(name, KindIndex)
+	}
+
+	return r
+}
+
+// Has reports whether name is a bucket or an index
+func (r *Registry) Has(name []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.names[string(name)]
+	return ok
+}
+
+// IsIndex reports whether name is an index
+func (r *Registry) IsIndex(name []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return hasKind(r.names[string(name)], KindIndex)
+}
+
+// Buckets, Indexes and All return the sorted names
+func (r *Registry) Buckets() []string {
+	return r.list(KindBucket)
+}
+
+func (r *Registry) Indexes() []string {
+	return r.list(KindIndex)
+}
+
+func (r *Registry) All() []string {
+	return r.list("")
+}
+
+func (r *Registry) list(kind BucketKind) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := []string{}
+	for name, kinds := range r.names {
+		if kind == "" || hasKind(kinds, kind) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Check returns ErrInvalidBucket for names that can not be created: empty ones and the ones starting
+// with "[", kept for the stores' own buckets.
+func (r *Registry) Check(name []byte) error {
+	if len(name) == 0 || strings.HasPrefix(string(name), "[") {
+		return ErrInvalidBucket
+	}
+
+	return nil
+}
+
+// Add registers name as kind, call it once the bucket exists
+func (r *Registry) Add(name []byte, kind BucketKind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(string(name), kind)
+}
+
+func (r *Registry) add(name string, kind BucketKind) {
+	if !hasKind(r.names[name], kind) {
+		r.names[name] = append(r.names[name], kind)
+	}
+}
+
+// Reset replaces every name with the ones of o, e.g. after a Restore
+func (r *Registry) Reset(o *Registry) {
+	o.mu.RLock()
+	names := make(map[string][]BucketKind, len(o.names))
+	for name, kinds := range o.names {
+		names[name] = append([]BucketKind{}, kinds...)
+	}
+	o.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.names = names
+}
+
+// Save writes every name to the RegistryBucket of t, records already there keep their creation time and count
+func (r *Registry) Save(t *bolt.Tx) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for name, kinds := range r.names {
+		for _, kind := range kinds {
+			err := saveKind(t, []byte(name), kind)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Create checks name and saves it with kind added to the RegistryBucket of t.
+// Add it to the registry once t is committed.
+func (r *Registry) Create(t *bolt.Tx, name []byte, kind BucketKind) error {
+	err := r.Check(name)
+	if err != nil {
+		return err
+	}
+
+	return saveKind(t, name, kind)
+}
+
+// Load adds the names saved in the RegistryBucket of t
+func (r *Registry) Load(t *bolt.Tx) error {
+	catalog, err := Catalog(t)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, info := range catalog {
+		for _, kind := range info.Kinds {
+			r.add(info.Name, kind)
+		}
+	}
+
+	return nil
+}
+
+// Catalog returns the records of the RegistryBucket of t, sorted by name. A record that does not decode
+// is an error, its count and kinds can not be trusted.
+func Catalog(t *bolt.Tx) ([]BucketInfo, error) {
+	list := []BucketInfo{}
+
+	root := t.Bucket(RegistryBucket)
+	if root == nil {
+		return list, nil
+	}
+
+	err := root.ForEach(func(name, v []byte) error {
+		info, err := decodeBucketInfo(name, v)
+		if err != nil {
+			return err
+		}
+
+		list = append(list, info)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// ReadBucketInfo returns the record of name in the RegistryBucket of t, false without one
+func ReadBucketInfo(t *bolt.Tx, name []byte) (BucketInfo, bool, error) {
+	root := t.Bucket(RegistryBucket)
+	if root == nil {
+		return BucketInfo{}, false, nil
+	}
+
+	v := root.Get(name)
+	if v == nil {
+		return BucketInfo{}, false, nil
+	}
+
+	info, err := decodeBucketInfo(name, v)
+	if err != nil {
+		return BucketInfo{}, false, err
+	}
+
+	return info, true, nil
+}
+
+func decodeBucketInfo(name, v []byte) (BucketInfo, error) {
+	info := BucketInfo{}
+	err := json.Unmarshal(v, &info)
+	if err != nil {
+		return BucketInfo{}, fmt.Errorf("bucket record %s: %w", name, err)
+	}
+
+	info.Name = string(name)
+	return info, nil
+}
+
+// WriteBucketInfo writes the record of info.Name to the RegistryBucket of t
+func WriteBucketInfo(t *bolt.Tx, info BucketInfo) error {
+	root, err := t.CreateBucketIfNotExists(RegistryBucket)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(info.Kinds, func(i, j int) bool { return info.Kinds[i] < info.Kinds[j] })
+
+	v, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return root.Put([]byte(info.Name), v)
+}
+
+// AddCount adds delta to the item count of the record of name, names without record are skipped
+func AddCount(t *bolt.Tx, name []byte, delta int) error {
+	info, ok, err := ReadBucketInfo(t, name)
+	if err != nil || !ok || delta == 0 {
+		return err
+	}
+
+	info.Count += delta
+	if info.Count < 0 {
+		info.Count = 0
+	}
+
+	return WriteBucketInfo(t, info)
+}
+
+// saveKind adds kind to the record of name, creating it if needed
+func saveKind(t *bolt.Tx, name []byte, kind BucketKind) error {
+	info, ok, err := ReadBucketInfo(t, name)
+	if err != nil || ok && info.Is(kind) {
+		return err
+	}
+
+	if !ok {
+		info = BucketInfo{Name: string(name), Created: time.Now().UTC()}
+	}
+
+	info.Kinds = append(info.Kinds, kind)
+	return WriteBucketInfo(t, info)
+}
+
+func hasKind(kinds []BucketKind, kind BucketKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
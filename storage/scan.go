@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+)
+
+// ScanOptions selects the keys of a bucket Scan returns. Keys compare as bytes: the range starts at Start
+// (included) and ends at End (excluded unless Inclusive), nil for either end of the bucket, and holds only
+// the keys starting with Prefix. Reverse walks it from its end, Limit caps the items, 0 for no limit.
+type ScanOptions struct {
+	Prefix    []byte
+	Start     []byte
+	End       []byte
+	Inclusive bool
+	Reverse   bool
+	Limit     int
+}
+
+// ScanCursor is the part of a bolt cursor Walk needs
+type ScanCursor interface {
+	First() ([]byte, []byte)
+	Last() ([]byte, []byte)
+	Seek(seek []byte) ([]byte, []byte)
+	Next() ([]byte, []byte)
+	Prev() ([]byte, []byte)
+}
+
+// Walk seeks c to the range of o and calls fn with its keys in order, until Limit keys were taken or fn fails.
+// fn reports whether it took the key, so skipped keys (expired ones) do not count.
+func (o ScanOptions) Walk(c ScanCursor, fn func(k, v []byte) (bool, error)) error {
+	taken := 0
+	visit := func(k, v []byte) (bool, error) {
+		ok, err := fn(k, v)
+		if ok {
+			taken++
+		}
+
+		return err == nil && (o.Limit <= 0 || taken < o.Limit), err
+	}
+
+	lower := o.lower()
+
+	if o.Reverse {
+		bound, inclusive := o.upper()
+		for k, v := seekLast(c, bound, inclusive); k != nil; k, v = c.Prev() {
+			if lower != nil && bytes.Compare(k, lower) < 0 || !bytes.HasPrefix(k, o.Prefix) {
+				return nil
+			}
+
+			more, err := visit(k, v)
+			if !more {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	k, v := c.First()
+	if lower != nil {
+		k, v = c.Seek(lower)
+	}
+
+	for ; k != nil; k, v = c.Next() {
+		if o.past(k) || !bytes.HasPrefix(k, o.Prefix) {
+			return nil
+		}
+
+		more, err := visit(k, v)
+		if !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lower returns the first key of the range, the greater of Start and Prefix
+func (o ScanOptions) lower() []byte {
+	if len(o.Prefix) > 0 && bytes.Compare(o.Start, o.Prefix) < 0 {
+		return o.Prefix
+	}
+
+	return o.Start
+}
+
+// upper returns the tighter end of the range, End or the first key after the Prefix ones, and whether it is included
+func (o ScanOptions) upper() ([]byte, bool) {
+	after := prefixEnd(o.Prefix)
+	if after == nil || o.End != nil && bytes.Compare(o.End, after) < 0 {
+		return o.End, o.Inclusive && o.End != nil
+	}
+
+	return after, false
+}
+
+// past reports whether k comes after End
+func (o ScanOptions) past(k []byte) bool {
+	if o.End == nil {
+		return false
+	}
+
+	cmp := bytes.Compare(k, o.End)
+	return cmp > 0 || cmp == 0 && !o.Inclusive
+}
+
+// seekLast moves c to the last key before bound, or at it when inclusive; nil bound is the last key
+func seekLast(c ScanCursor, bound []byte, inclusive bool) ([]byte, []byte) {
+	if bound == nil {
+		return c.Last()
+	}
+
+	k, v := c.Seek(bound)
+	if k == nil {
+		return c.Last()
+	}
+
+	if inclusive && bytes.Equal(k, bound) {
+		return k, v
+	}
+
+	return c.Prev()
+}
+
+// prefixEnd returns the first key after every key starting with prefix, nil when there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"fmt"
+)
+
+// Option configures a Scheduler in New
+type Option func(*Scheduler) error
+
+// Name sets the time.Format layout naming every backup directory, default "backup-20060102-150405".
+// Directories of dir that do not parse with it are never pruned.
+func Name(layout string) Option {
+	return func(s *Scheduler) error {
+		if layout == "" {
+			return fmt.Errorf("scheduler: empty name layout")
+		}
+
+		s.layout = layout
+		return nil
+	}
+}
+
+// KeepLast keeps the n newest backups
+func KeepLast(n int) Option {
+	return func(s *Scheduler) error {
+		s.keepLast = n
+		return nil
+	}
+}
+
+// KeepDaily keeps the newest backup of each of the last n days that have one
+func KeepDaily(n int) Option {
+	return func(s *Scheduler) error {
+		s.keepDaily = n
+		return nil
+	}
+}
+
+// KeepWeekly keeps the newest backup of each of the last n ISO weeks that have one
+func KeepWeekly(n int) Option {
+	return func(s *Scheduler) error {
+		s.keepWeekly = n
+		return nil
+	}
+}
+
+// OnResult is called after every scheduled backup, successful or not
+func OnResult(fn func(r Result)) Option {
+	return func(s *Scheduler) error {
+		s.onResult = fn
+		return nil
+	}
+}
@@ -0,0 +1,266 @@
+// Package scheduler takes backups of an open store at an interval and prunes the old ones.
+//
+// Every backup goes to its own directory under dir, named after the time it started, and holds
+// the files store.Backup writes. With no Keep option every backup is kept, otherwise a backup
+// stays while any of KeepLast, KeepDaily or KeepWeekly keeps it.
+//
+//	sched, err := scheduler.New(store, "./backups", time.Hour,
+//		scheduler.KeepLast(24), scheduler.KeepDaily(7), scheduler.KeepWeekly(4),
+//		scheduler.OnResult(func(r scheduler.Result) {
+//			if r.Err != nil {
+//				log.Printf("backup %s: %v", r.Name, r.Err)
+//			}
+//		}))
+//	...
+//	sched.Start()
+//	defer sched.Stop()
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+)
+
+// filename is the Backup filename inside every backup directory
+const filename = "backup"
+
+// Scheduler runs store.Backup every interval, see the package doc
+type Scheduler struct {
+	store    interfaces.Storage
+	dir      string
+	interval time.Duration
+
+	layout     string
+	keepLast   int
+	keepDaily  int
+	keepWeekly int
+	onResult   func(r Result)
+	now        func() time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Result reports one backup: its name and directory, the backups pruned after it and the first error
+type Result struct {
+	Name    string
+	Path    string
+	Started time.Time
+	Took    time.Duration
+	Pruned  []string
+	Err     error
+}
+
+// New returns a scheduler backing up store to dir every interval, Start runs it
+func New(store interfaces.Storage, dir string, interval time.Duration, opts ...Option) (*Scheduler, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("scheduler: invalid interval %s", interval)
+	}
+
+	s := &Scheduler{
+		store:    store,
+		dir:      dir,
+		interval: interval,
+		layout:   "backup-20060102-150405",
+		now:      time.Now,
+	}
+
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Start takes a backup every interval until Stop, the first one after one interval
+func (s *Scheduler) Start() {
+	if s.stop != nil {
+		return
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.loop()
+}
+
+// Stop stops the scheduler and waits for a running backup to finish
+func (s *Scheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r := s.Run()
+			if s.onResult != nil {
+				s.onResult(r)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Run takes one backup now and prunes, without calling OnResult
+func (s *Scheduler) Run() (r Result) {
+	r.Started = s.now()
+	r.Name = r.Started.Format(s.layout)
+	r.Path = filepath.Join(s.dir, r.Name)
+
+	defer func() {
+		r.Took = time.Since(r.Started)
+	}()
+
+	if _, err := os.Stat(r.Path); err == nil {
+		r.Err = fmt.Errorf("scheduler: backup %s exists", r.Name)
+		return r
+	}
+
+	err := storage.CreateDir(r.Path)
+	if err == nil {
+		err = s.store.Backup(r.Path+"/", filename)
+	}
+
+	if err != nil {
+		// A failed backup must not count for retention
+		_ = os.RemoveAll(r.Path)
+		r.Err = fmt.Errorf("scheduler: backup %s: %w", r.Name, err)
+		return r
+	}
+
+	r.Pruned, err = s.prune()
+	if err != nil {
+		r.Err = fmt.Errorf("scheduler: prune: %w", err)
+	}
+
+	return r
+}
+
+// backup is a backup directory found in dir
+type backup struct {
+	name    string
+	created time.Time
+}
+
+// Backups returns the names of the backups in dir, newest first
+func (s *Scheduler) Backups() ([]string, error) {
+	backups, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(backups))
+	for i, b := range backups {
+		names[i] = b.name
+	}
+
+	return names, nil
+}
+
+func (s *Scheduler) list() ([]backup, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []backup{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		created, err := time.ParseInLocation(s.layout, entry.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backup{name: entry.Name(), created: created})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].created.After(backups[j].created)
+	})
+
+	return backups, nil
+}
+
+// prune removes the backups retention does not keep
+func (s *Scheduler) prune() ([]string, error) {
+	if s.keepLast <= 0 && s.keepDaily <= 0 && s.keepWeekly <= 0 {
+		return nil, nil
+	}
+
+	backups, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := keep(backups, s.keepLast, s.keepDaily, s.keepWeekly)
+
+	pruned := []string{}
+	for _, b := range backups {
+		if kept[b.name] {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(s.dir, b.name))
+		if err != nil {
+			return pruned, err
+		}
+
+		pruned = append(pruned, b.name)
+	}
+
+	return pruned, nil
+}
+
+// keep returns the backups (newest first) any of the rules keeps
+func keep(backups []backup, last, daily, weekly int) map[string]bool {
+	kept := map[string]bool{}
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+
+	for i, b := range backups {
+		if i < last {
+			kept[b.name] = true
+		}
+
+		day := b.created.Format("2006-01-02")
+		if !days[day] && len(days) < daily {
+			days[day] = true
+			kept[b.name] = true
+		}
+
+		year, week := b.created.ISOWeek()
+		id := fmt.Sprintf("%d-%02d", year, week)
+		if !weeks[id] && len(weeks) < weekly {
+			weeks[id] = true
+			kept[b.name] = true
+		}
+	}
+
+	return kept
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	memorystorage "github.com/uretgec/mydb/storage/memory"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeep(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) // a monday
+
+	// Every 12 hours over 20 days, newest first
+	backups := []backup{}
+	for i := 39; i >= 0; i-- {
+		created := start.Add(time.Duration(i) * 12 * time.Hour)
+		backups = append(backups, backup{name: created.Format(time.RFC3339), created: created})
+	}
+
+	assert.Equal(t, 3, len(keep(backups, 3, 0, 0)))
+	assert.Equal(t, 5, len(keep(backups, 0, 5, 0)))
+	assert.Equal(t, 3, len(keep(backups, 0, 0, 3)))
+
+	// The newest backup of a day is kept
+	kept := keep(backups, 0, 1, 0)
+	assert.Equal(t, true, kept[backups[0].name])
+
+	// Rules add up, a backup counts for all of them: the two newest are the last, the daily
+	// and one weekly backup, the second weekly one is the newest of the week before
+	kept = keep(backups, 2, 2, 2)
+	assert.Equal(t, 3, len(kept))
+	assert.Equal(t, true, kept[start.Add(13*24*time.Hour).Format(time.RFC3339)])
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := memorystorage.NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, "", "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	sched, err := New(store, dir, time.Hour, KeepLast(2))
+	assert.NoError(t, err)
+
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	sched.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+
+	for i := 0; i < 3; i++ {
+		r := sched.Run()
+		assert.NoError(t, r.Err)
+
+		_, err = os.Stat(filepath.Join(r.Path, filename+".backup"))
+		assert.NoError(t, err)
+	}
+
+	names, err := sched.Backups()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"backup-20240101-120300", "backup-20240101-120200"}, names)
+
+	// Directories that are not backups are left alone
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "keep-me"), 0755))
+	r := sched.Run()
+	assert.NoError(t, r.Err)
+	assert.Equal(t, []string{"backup-20240101-120200"}, r.Pruned)
+
+	_, err = os.Stat(filepath.Join(dir, "keep-me"))
+	assert.NoError(t, err)
+
+	// Failures are reported through OnResult
+	file := filepath.Join(dir, "not-a-dir")
+	assert.NoError(t, os.WriteFile(file, nil, 0600))
+
+	results := make(chan Result, 1)
+	failing, err := New(store, file, 10*time.Millisecond, OnResult(func(r Result) {
+		select {
+		case results <- r:
+		default:
+		}
+	}))
+	assert.NoError(t, err)
+
+	failing.Start()
+	r = <-results
+	failing.Stop()
+	assert.Error(t, r.Err)
+
+	assert.NoError(t, store.CloseStore())
+}
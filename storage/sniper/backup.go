@@ -0,0 +1,382 @@
+package sniperstorage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// backend names the archives of this store, archiveName is the Backup filename inside them
+const (
+	backend     = "sniper"
+	archiveName = "snapshot"
+)
+
+// manifest extends storage.BackupManifest, whose buckets are the index buckets, with the sniper
+// key counts. Restore checks the restored store against it.
+type manifest struct {
+	storage.BackupManifest
+	Keys     int `json:"keys"`     // sniper keys, expired ones not swept yet included
+	Expiring int `json:"expiring"` // keys with an expiry, they may be gone by the time of the restore
+}
+
+// Backup writes one consistent snapshot: the sniper data to path/filename, the index db to
+// path/index-filename.backup and last the manifest to path/filename.manifest.
+// The files are compressed and encrypted as the backup options ask. Every other call waits while it runs.
+func (s *Store) Backup(path, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backup(path, filename, s.backupOptions)
+}
+
+// backup writes the Backup files encoded as o asks, the caller holds the fence
+func (s *Store) backup(path, filename string, o storage.BackupOptions) error {
+	// Create dir if necessary
+	_ = storage.CreateDir(path)
+
+	err := s.db.Backup(dataBackup(path, filename))
+	if err != nil {
+		return err
+	}
+
+	m := &manifest{Keys: s.db.Count()}
+	err = s.dbIndex.View(func(tx *bolt.Tx) error {
+		if root := tx.Bucket(ttlBucket); root != nil {
+			err := root.ForEach(func(bucketName, _ []byte) error {
+				m.Expiring += root.Bucket(bucketName).Stats().KeyN
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.CopyFile(indexBackup(path, filename), 0600)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	index := "index-" + filename + ".backup"
+
+	bm, err := storage.NewBackupManifest(backend, path, index, s.registry.Indexes(), filename, index)
+	if err == nil {
+		err = bm.Encode(path, o)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.BackupManifest = *bm
+
+	return storage.WriteManifest(storage.ManifestFile(path, filename), m)
+}
+
+// Restore replaces the sniper data and the index with a backup written by Backup. The backup is verified
+// against its manifest first (see storage.VerifyBackup) and decoded when it is compressed or encrypted,
+// the restored store is checked against its key counts. Backups without manifest are restored unchecked,
+// their keys migrated. On any failure the current data and index are kept as they were.
+func (s *Store) Restore(path, filename string) error {
+	if s.readOnly {
+		return fmt.Errorf("restore: %w", storage.ErrReadOnly)
+	}
+
+	// Backups without manifest predate it and are taken as they are
+	var m *manifest
+	if _, statErr := os.Stat(storage.ManifestFile(path, filename)); statErr == nil {
+		m = &manifest{}
+		err := storage.ReadManifest(storage.ManifestFile(path, filename), m)
+		if err == nil {
+			err = storage.VerifyBackupWithKey(path, filename, s.backupOptions.Key)
+		}
+
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", filename, err)
+		}
+	}
+
+	// Decode next to the index db, so the final rename stays on one filesystem
+	tmp := s.indexFile + ".restore"
+	err := storage.DecodeFile(indexBackup(path, filename), tmp, s.backupOptions.Key)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("restore %s: %w", filename, err)
+	}
+	defer os.Remove(tmp)
+
+	// sniper reads its own backup format only
+	data := dataBackup(path, filename)
+
+	encoded := m != nil && (m.Compressed || m.Encrypted)
+	if m == nil {
+		encoded, err = storage.IsEncoded(data)
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", filename, err)
+		}
+	}
+
+	if encoded {
+		data = s.indexFile + ".data"
+		err = storage.DecodeFile(dataBackup(path, filename), data, s.backupOptions.Key)
+		if err != nil {
+			_ = os.Remove(data)
+			return fmt.Errorf("restore %s: %w", filename, err)
+		}
+		defer os.Remove(data)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = s.db.Close()
+	_ = s.dbIndex.Close()
+	s.db, s.dbIndex = nil, nil
+
+	err = s.swap(data, tmp, m)
+	if err == nil {
+		_ = os.RemoveAll(s.dir + ".old")
+		return os.Remove(s.indexFile + ".old")
+	}
+
+	openErr := s.rollback()
+	if openErr != nil {
+		return fmt.Errorf("restore %s: %v, reopen: %w", filename, err, openErr)
+	}
+
+	return fmt.Errorf("restore %s: %w", filename, err)
+}
+
+// swap moves the current data and index aside and opens the restored ones in their place, m is nil
+// for backups without manifest. Intents the backup holds are recovered like on open.
+func (s *Store) swap(dataBackup, indexFile string, m *manifest) error {
+	// Left by a restore cut short, the current data is what was opened
+	_ = os.RemoveAll(s.dir + ".old")
+	_ = os.Remove(s.indexFile + ".old")
+
+	err := os.Rename(s.dir, s.dir+".old")
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(s.indexFile, s.indexFile+".old")
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(indexFile, s.indexFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := sniper.Open(sniper.Dir(s.dir))
+	if err != nil {
+		return err
+	}
+
+	s.db = db
+
+	err = s.db.Restore(dataBackup)
+	if err != nil {
+		return err
+	}
+
+	dbIndex, err := s.openIndex()
+	if err != nil {
+		return err
+	}
+
+	s.dbIndex = dbIndex
+
+	// Backups taken before the key format get migrated
+	err = s.migrateKeys()
+	if err != nil {
+		return err
+	}
+
+	// The manifest describes the backup as taken
+	if m != nil {
+		err = s.verify(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.recoverIntents()
+	if err != nil {
+		return err
+	}
+
+	return s.syncValueIndexes()
+}
+
+// rollback drops whatever swap restored, moves the current data and index back and reopens them
+func (s *Store) rollback() error {
+	if s.db != nil {
+		_ = s.db.Close()
+	}
+
+	if s.dbIndex != nil {
+		_ = s.dbIndex.Close()
+	}
+
+	if _, err := os.Stat(s.dir + ".old"); err == nil {
+		_ = os.RemoveAll(s.dir)
+		_ = os.Rename(s.dir+".old", s.dir)
+	}
+
+	if _, err := os.Stat(s.indexFile + ".old"); err == nil {
+		_ = os.Remove(s.indexFile)
+		_ = os.Rename(s.indexFile+".old", s.indexFile)
+	}
+
+	db, err := sniper.Open(sniper.Dir(s.dir))
+	if err != nil {
+		return err
+	}
+
+	s.db = db
+
+	dbIndex, err := s.openIndex()
+	if err != nil {
+		return err
+	}
+
+	s.dbIndex = dbIndex
+
+	return nil
+}
+
+// verify checks the restored store against the manifest: sniper drops keys that expired since
+// the backup, index buckets must match exactly and every indexed key must have its data.
+func (s *Store) verify(m *manifest) error {
+	keys := s.db.Count()
+	if keys > m.Keys || keys < m.Keys-m.Expiring {
+		return fmt.Errorf("restored %d keys, backup has %d", keys, m.Keys)
+	}
+
+	return s.dbIndex.View(func(t *bolt.Tx) error {
+		for indexName, n := range m.Buckets {
+			b := t.Bucket([]byte(indexName))
+			if b == nil || b.Stats().KeyN != n {
+				return fmt.Errorf("restored index %s does not match the backup", indexName)
+			}
+
+			err := b.ForEach(func(k, _ []byte) error {
+				if expired(t, []byte(indexName), k) {
+					return nil
+				}
+
+				_, err := s.db.Get(dataKey([]byte(indexName), k))
+				if err == sniper.ErrNotFound {
+					return fmt.Errorf("restored index %s has key %s without data", indexName, k)
+				}
+
+				return err
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// BackupTo streams a backup archive (see storage.ArchiveWriter) holding the three Backup files to w,
+// compressed and encrypted as a whole as the backup options ask
+func (s *Store) BackupTo(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "mydb-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The archive is encoded as a whole, its files stay plain
+	s.mu.Lock()
+	err = s.backup(dir+"/", archiveName, storage.BackupOptions{})
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	bw, err := storage.NewBackupWriter(w, s.backupOptions)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		archiveName:                        dataBackup(dir, archiveName),
+		"index-" + archiveName + ".backup": indexBackup(dir, archiveName),
+		archiveName + ".manifest":          storage.ManifestFile(dir, archiveName),
+	}
+
+	names := []string{archiveName, "index-" + archiveName + ".backup", archiveName + ".manifest"}
+
+	a, err := storage.NewArchiveWriter(bw, backend, names...)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = a.AddFile(name, files[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.Close()
+	if err != nil {
+		return err
+	}
+
+	return bw.Close()
+}
+
+// RestoreFrom reads an archive written by BackupTo and restores it like Restore
+func (s *Store) RestoreFrom(r io.Reader) error {
+	if s.readOnly {
+		return fmt.Errorf("restorefrom: %w", storage.ErrReadOnly)
+	}
+
+	dir, err := os.MkdirTemp("", "mydb-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	r, err = storage.NewBackupReader(r, s.backupOptions.Key)
+	if err != nil {
+		return fmt.Errorf("restorefrom: %w", err)
+	}
+
+	m, err := storage.ReadArchive(r, dir)
+	if err != nil {
+		return fmt.Errorf("restorefrom: %w", err)
+	}
+
+	if m.Backend != backend {
+		return fmt.Errorf("restorefrom: archive of %s, not %s", m.Backend, backend)
+	}
+
+	return s.Restore(dir+"/", archiveName)
+}
+
+func dataBackup(path, filename string) string {
+	return strings.TrimSuffix(path, "/") + "/" + filename
+}
+
+func indexBackup(path, filename string) string {
+	return strings.TrimSuffix(path, "/") + "/index-" + filename + ".backup"
+}
@@ -0,0 +1,85 @@
+package sniperstorage
+
+import (
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Sniper can not count or walk the keys of a bucket, so the index db keeps a catalog record per bucket
+// (see storage.BucketInfo) whose count every write updates in its index transaction.
+
+// Catalog returns the catalog record of every bucket and index, sorted by name
+func (s *Store) Catalog() ([]storage.BucketInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []storage.BucketInfo
+	err := s.dbIndex.View(func(t *bolt.Tx) (err error) {
+		list, err = storage.Catalog(t)
+		return err
+	})
+
+	return list, err
+}
+
+// counted reports whether a key is in the bucket count. An index counts its indexed keys, a bucket
+// without index the keys sniper holds and the expired ones not swept yet.
+func (s *Store) counted(t *bolt.Tx, bucketName []byte, k []byte) (bool, error) {
+	if s.registry.IsIndex(bucketName) {
+		b := t.Bucket(bucketName)
+		return b != nil && b.Get(k) != nil, nil
+	}
+
+	if expiry(t, bucketName, k) > 0 {
+		return true, nil
+	}
+
+	_, err := s.db.Get(dataKey(bucketName, k))
+	if err == sniper.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// seedCounts starts the count of the records of names that are indexes with their index key count
+func seedCounts(t *bolt.Tx, names []string) error {
+	for _, name := range names {
+		info, ok, err := storage.ReadBucketInfo(t, []byte(name))
+		if err != nil {
+			return err
+		}
+
+		b := t.Bucket([]byte(name))
+		if !ok || b == nil || !info.Is(storage.KindIndex) {
+			continue
+		}
+
+		info.Count = b.Stats().KeyN
+		err = storage.WriteBucketInfo(t, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uncatalogued returns the names of the registry without a catalog record yet
+func (s *Store) uncatalogued(t *bolt.Tx) ([]string, error) {
+	names := []string{}
+	for _, name := range s.registry.All() {
+		_, ok, err := storage.ReadBucketInfo(t, []byte(name))
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
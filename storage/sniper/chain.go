@@ -0,0 +1,138 @@
+package sniperstorage
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BackupChain adds a backup to the chain kept in dir (see storage.Chain). A full backup writes the
+// Backup files and starts logging changed keys in the index db (see storage.ChangesBucket), incremental
+// and differential ones only hold the keys changed since the previous or the last full backup. Keys
+// without bucket are not logged. When the changelog does not follow the chain, e.g. after a Restore,
+// a full backup is taken whatever kind asks for.
+func (s *Store) BackupChain(dir string, kind storage.BackupKind) (*storage.ChainBackup, error) {
+	if s.readOnly {
+		return nil, fmt.Errorf("backupchain: %w", storage.ErrReadOnly)
+	}
+
+	// Create dir if necessary
+	_ = storage.CreateDir(dir)
+
+	// No writes while the backup and the changelog move on together
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, b, err := storage.NextChainBackup(s.dbIndex, dir, backend, kind)
+	if err != nil {
+		return nil, fmt.Errorf("backupchain: %w", err)
+	}
+
+	var files []string
+	if b.Kind == storage.BackupFull {
+		files = []string{b.Name, "index-" + b.Name + ".backup", b.Name + ".manifest"}
+		err = s.backup(dir+"/", b.Name, s.backupOptions)
+
+		if err == nil {
+			err = s.dbIndex.Update(func(t *bolt.Tx) error {
+				return storage.ResetChangelog(t, c.ID)
+			})
+		}
+	} else {
+		files = []string{b.Name + ".changes"}
+		err = s.writeChanges(filepath.Join(dir, files[0]), b.Kind)
+	}
+
+	if err == nil {
+		err = c.Add(dir, b, files...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("backupchain: %w", err)
+	}
+
+	return &b, nil
+}
+
+// RestoreChain restores the store as of backup seq of the chain in dir, -1 for the last one: the full
+// backup is restored, then the differential and incremental backups after it are replayed. Sniper
+// can not stage the replay, a failed one leaves the store as of the full backup. Every file is checked
+// against its checksum first. The changelog is dropped, so the next BackupChain is full.
+func (s *Store) RestoreChain(dir string, seq int) error {
+	if s.readOnly {
+		return fmt.Errorf("restorechain: %w", storage.ErrReadOnly)
+	}
+
+	plan, err := storage.ChainPlan(dir, backend, seq)
+	if err != nil {
+		return fmt.Errorf("restorechain: %w", err)
+	}
+
+	err = s.Restore(dir+"/", plan[0].Name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.dbIndex.Update(storage.DropChangelog)
+	if err != nil {
+		return fmt.Errorf("restorechain: %w", err)
+	}
+
+	for _, b := range plan[1:] {
+		err = storage.ReadChanges(filepath.Join(dir, b.Name+".changes"), s.backupOptions.Key, s.apply)
+		if err != nil {
+			return fmt.Errorf("restorechain: backup %d: %w", b.Seq, err)
+		}
+	}
+
+	return nil
+}
+
+// writeChanges writes the logged keys to file, with their current value or as deleted, then
+// moves to the next generation
+func (s *Store) writeChanges(file string, kind storage.BackupKind) error {
+	err := s.dbIndex.View(func(t *bolt.Tx) error {
+		return storage.WriteChangelog(t, file, s.backupOptions, kind, func(bucketName, k []byte) (storage.Change, error) {
+			change := storage.Change{Bucket: bucketName, Key: k}
+
+			value, err := s.db.Get(dataKey(bucketName, k))
+			if err != nil && err != sniper.ErrNotFound {
+				return change, err
+			}
+
+			if len(value) > 0 {
+				change.Value = value
+				change.Expire = expiry(t, bucketName, k)
+			}
+
+			return change, nil
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return s.dbIndex.Update(storage.NextGeneration)
+}
+
+// apply writes one change of a chain backup, keys of buckets the store no longer declares are skipped
+func (s *Store) apply(change storage.Change) error {
+	if !s.registry.Has(change.Bucket) {
+		return nil
+	}
+
+	if change.Value == nil {
+		return s.delete(change.Bucket, change.Key)
+	}
+
+	_, err := s.set(change.Bucket, change.Key, change.Value, change.Expire)
+	return err
+}
@@ -0,0 +1,228 @@
+package sniperstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A write to a bucket touches sniper and the index db, which can not commit together. It first commits
+// an intent to intentBucket, then writes sniper and updates the index in one index transaction that also
+// drops the intent. An intent left behind means the write was cut short: recoverIntents completes it if its
+// data reached sniper and drops it otherwise, the index transaction never committed. Expire needs no intent,
+// the expiry it works from stays until its transaction commits.
+
+// intentBucket lives in the index db: id -> intent json
+var intentBucket = []byte("[intents]")
+
+const (
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+type intent struct {
+	Op     string      `json:"op"`
+	Bucket []byte      `json:"bucket"`
+	Keys   []intentKey `json:"keys"`
+}
+
+type intentKey struct {
+	Key     []byte `json:"key"`
+	Sum     uint32 `json:"sum,omitempty"`    // crc32 of the value, set only
+	Expire  int64  `json:"expire,omitempty"` // as passed to set, unix nano
+	Counted bool   `json:"counted"`          // in the bucket count before the write
+}
+
+// journal commits in and returns its id, the count of every key is read in the same transaction
+func (s *Store) journal(commit func(func(*bolt.Tx) error) error, in *intent) ([]byte, error) {
+	var id []byte
+	err := commit(func(t *bolt.Tx) error {
+		b, err := t.CreateBucketIfNotExists(intentBucket)
+		if err != nil {
+			return err
+		}
+
+		for i := range in.Keys {
+			in.Keys[i].Counted, err = s.counted(t, in.Bucket, in.Keys[i].Key)
+			if err != nil {
+				return err
+			}
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		id = storage.U64tob(int(seq))
+		return b.Put(id, v)
+	})
+
+	return id, err
+}
+
+// settle drops the intent id once its write is done, in the write's index transaction
+func settle(t *bolt.Tx, id []byte) error {
+	b := t.Bucket(intentBucket)
+	if b == nil {
+		return nil
+	}
+
+	return b.Delete(id)
+}
+
+// abort recovers the intent of a write that failed, it stays for the next NewStore if that fails too
+func (s *Store) abort(id []byte, err error) error {
+	_ = s.dbIndex.Update(func(t *bolt.Tx) error {
+		return s.recoverIntent(t, id)
+	})
+
+	return err
+}
+
+// recoverIntents completes or drops every intent left by writes cut short, NewStore calls it
+func (s *Store) recoverIntents() error {
+	if s.readOnly {
+		return nil
+	}
+
+	err := s.dbIndex.Update(func(t *bolt.Tx) error {
+		b := t.Bucket(intentBucket)
+		if b == nil {
+			return nil
+		}
+
+		var ids [][]byte
+		_ = b.ForEach(func(id, _ []byte) error {
+			ids = append(ids, append([]byte{}, id...))
+			return nil
+		})
+
+		for _, id := range ids {
+			err := s.recoverIntent(t, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("recover intents: %w", err)
+	}
+
+	return nil
+}
+
+// recoverIntent completes the keys of intent id whose write reached sniper, then drops the intent
+func (s *Store) recoverIntent(t *bolt.Tx, id []byte) error {
+	b := t.Bucket(intentBucket)
+	if b == nil || b.Get(id) == nil {
+		return nil
+	}
+
+	in := intent{}
+	err := json.Unmarshal(b.Get(id), &in)
+	if err != nil {
+		return err
+	}
+
+	for _, ik := range in.Keys {
+		v, err := s.db.Get(dataKey(in.Bucket, ik.Key))
+		if err != nil && err != sniper.ErrNotFound {
+			return err
+		}
+
+		switch {
+		case in.Op == opSet && err == nil && crc32.ChecksumIEEE(v) == ik.Sum:
+			err = s.completeSet(t, in.Bucket, ik, v)
+		case in.Op == opDelete && err == sniper.ErrNotFound:
+			err = s.completeDelete(t, in.Bucket, ik)
+		default:
+			// Sniper was not written, neither was the index
+			err = nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Delete(id)
+}
+
+// completeSet writes the rest of a set: v again with its expiry, the index key, the count and the expiry
+func (s *Store) completeSet(t *bolt.Tx, bucketName []byte, ik intentKey, v []byte) error {
+	seconds, expire := expireSeconds(ik.Expire)
+
+	err := s.db.Set(dataKey(bucketName, ik.Key), v, seconds)
+	if err != nil {
+		return err
+	}
+
+	if b := t.Bucket(bucketName); b != nil && s.registry.IsIndex(bucketName) {
+		err := b.Put(ik.Key, []byte(fmt.Sprint(0)))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = storage.SetValue(t, bucketName, ik.Key, v)
+	if err != nil {
+		return err
+	}
+
+	if !ik.Counted {
+		err = storage.AddCount(t, bucketName, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = storage.LogChange(t, bucketName, ik.Key)
+	if err != nil {
+		return err
+	}
+
+	return setExpiry(t, bucketName, ik.Key, expire)
+}
+
+// completeDelete drops the index key, the count and the expiry of a deleted key
+func (s *Store) completeDelete(t *bolt.Tx, bucketName []byte, ik intentKey) error {
+	if b := t.Bucket(bucketName); b != nil && s.registry.IsIndex(bucketName) {
+		err := b.Delete(ik.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := storage.DeleteValue(t, bucketName, ik.Key)
+	if err != nil {
+		return err
+	}
+
+	if ik.Counted {
+		err := storage.AddCount(t, bucketName, -1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = storage.LogChange(t, bucketName, ik.Key)
+	if err != nil {
+		return err
+	}
+
+	return setExpiry(t, bucketName, ik.Key, 0)
+}
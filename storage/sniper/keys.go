@@ -0,0 +1,290 @@
+package sniperstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Sniper keys are keyPrefix, the uvarint length of the bucket name, the bucket name and the key; keys without
+// bucket have length 0. The first format was the bucket name followed by the key, so bucket "post" key "s1"
+// and bucket "posts" key "1" shared one sniper key. migrateKeys rewrites data of that format once.
+const (
+	keyPrefix = 0x00
+	keyFormat = 1
+)
+
+// ErrAmbiguousKeys is returned by NewStore and Restore when keys of the first format start with more than
+// one bucket name and neither index nor expiries tell them apart. Nothing is migrated, read only stores
+// still read the data.
+var ErrAmbiguousKeys = errors.New("ambiguous keys of the first format")
+
+// metaBucket lives in the index db, keyFormatKey holds the key format of the data
+var (
+	metaBucket   = []byte("[meta]")
+	keyFormatKey = []byte("keyformat")
+)
+
+// dataKey returns the sniper key of k in bucketName
+func dataKey(bucketName []byte, k []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(n[:], uint64(len(bucketName)))
+
+	key := make([]byte, 0, 1+size+len(bucketName)+len(k))
+	key = append(key, keyPrefix)
+	key = append(key, n[:size]...)
+	key = append(key, bucketName...)
+
+	return append(key, k...)
+}
+
+// splitKey returns the bucket name and the key of a sniper key, false for keys of the first format
+func splitKey(key []byte) ([]byte, []byte, bool) {
+	if len(key) == 0 || key[0] != keyPrefix {
+		return nil, nil, false
+	}
+
+	size, n := binary.Uvarint(key[1:])
+	if n <= 0 || uint64(len(key)-1-n) < size {
+		return nil, nil, false
+	}
+
+	start := 1 + n
+	return key[start : start+int(size)], key[start+int(size):], true
+}
+
+// migrateKeys rewrites data of the first key format: it reads every key from a sniper backup, splits it
+// into bucket and key, writes it under dataKey and drops the old key, then recounts the buckets without
+// index. Keys already in the format are kept, so a run cut short is completed by the next one. It runs on
+// open and after restoring a backup whose index db does not record the format. Read only stores leave
+// the data as it is and read it through lookup, the next writable open migrates it.
+func (s *Store) migrateKeys() error {
+	var format []byte
+	err := s.dbIndex.View(func(t *bolt.Tx) error {
+		if b := t.Bucket(metaBucket); b != nil {
+			format = b.Get(keyFormatKey)
+		}
+
+		return nil
+	})
+
+	if err != nil || len(format) > 0 && format[0] >= keyFormat {
+		return err
+	}
+
+	if s.readOnly {
+		s.legacyKeys = s.db.Count() > 0
+		return nil
+	}
+
+	counts := map[string]int{}
+	if s.db.Count() > 0 {
+		counts, err = s.rewriteKeys()
+		if err != nil {
+			return fmt.Errorf("migrate keys: %w", err)
+		}
+	}
+
+	return s.dbIndex.Update(func(t *bolt.Tx) error {
+		catalog, err := storage.Catalog(t)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UnixNano()
+		for _, info := range catalog {
+			if info.Is(storage.KindIndex) {
+				continue
+			}
+
+			// Expired keys are counted until they are swept
+			info.Count = counts[info.Name]
+			if root := t.Bucket(ttlBucket); root != nil && root.Bucket([]byte(info.Name)) != nil {
+				_ = root.Bucket([]byte(info.Name)).ForEach(func(_, v []byte) error {
+					if int64(storage.Btou64(v)) <= now {
+						info.Count++
+					}
+
+					return nil
+				})
+			}
+
+			err := storage.WriteBucketInfo(t, info)
+			if err != nil {
+				return err
+			}
+		}
+
+		b, err := t.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(keyFormatKey, []byte{keyFormat})
+	})
+}
+
+// rewriteKeys moves every key of the first format to dataKey and returns the key count of every bucket
+func (s *Store) rewriteKeys() (map[string]int, error) {
+	file := s.dir + ".keys"
+	_ = os.Remove(file)
+
+	err := s.db.Backup(file)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file)
+
+	counts := map[string]int{}
+	err = s.dbIndex.View(func(t *bolt.Tx) error {
+		// Every key is split before the first one is written
+		var ambiguous []string
+		err := readBackup(file, func(key, _ []byte, _ uint32) error {
+			if _, _, ok := splitKey(key); ok {
+				return nil
+			}
+
+			if _, _, ok := s.splitOldKey(t, key); !ok {
+				ambiguous = append(ambiguous, string(key))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if len(ambiguous) > 0 {
+			return fmt.Errorf("%w: %s", ErrAmbiguousKeys, strings.Join(ambiguous, ", "))
+		}
+
+		return readBackup(file, func(key, value []byte, expire uint32) error {
+			if bucketName, _, ok := splitKey(key); ok {
+				counts[string(bucketName)]++
+				return nil
+			}
+
+			bucketName, k, _ := s.splitOldKey(t, key)
+			counts[string(bucketName)]++
+
+			// Write first, a crash in between leaves the old key for the next run
+			err := s.db.Set(dataKey(bucketName, k), value, expire)
+			if err != nil {
+				return err
+			}
+
+			_, err = s.db.Delete(key)
+			return err
+		})
+	})
+
+	return counts, err
+}
+
+// lookup reads k of bucketName, under its key of the first format too while the data is not migrated
+func (s *Store) lookup(bucketName []byte, k []byte) ([]byte, error) {
+	v, err := s.db.Get(dataKey(bucketName, k))
+	if err != sniper.ErrNotFound || !s.legacyKeys {
+		return v, err
+	}
+
+	key := make([]byte, 0, len(bucketName)+len(k))
+	key = append(key, bucketName...)
+
+	return s.db.Get(append(key, k...))
+}
+
+// splitOldKey splits a key of the first format. The bucket whose index or expiries hold the rest of
+// the key wins, then the only bucket name the key starts with; keys matching none had no bucket. It is
+// false when several bucket names match and none of them wins.
+func (s *Store) splitOldKey(t *bolt.Tx, key []byte) ([]byte, []byte, bool) {
+	var match []byte
+	matches := 0
+	for _, name := range s.registry.All() {
+		bucketName := []byte(name)
+		if len(bucketName) >= len(key) || !bytes.HasPrefix(key, bucketName) {
+			continue
+		}
+
+		k := key[len(bucketName):]
+		if b := t.Bucket(bucketName); b != nil && s.registry.IsIndex(bucketName) && b.Get(k) != nil {
+			return bucketName, k, true
+		}
+
+		if expiry(t, bucketName, k) > 0 {
+			return bucketName, k, true
+		}
+
+		match = bucketName
+		matches++
+	}
+
+	if matches > 1 {
+		return nil, key, false
+	}
+
+	return match, key[len(match):], true
+}
+
+// readBackup calls fn with every live record of a file written by sniper's Backup: a version byte, then
+// per record a header (size power, status, key length, value length, expiry), the value and the key.
+func readBackup(file string, fn func(key, value []byte, expire uint32) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	version, err := r.ReadByte()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	} else if version != 1 {
+		return fmt.Errorf("sniper backup version %d", version)
+	}
+
+	header := make([]byte, 12)
+	for {
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		keyLen := binary.BigEndian.Uint16(header[2:4])
+		valueLen := binary.BigEndian.Uint32(header[4:8])
+		expire := binary.BigEndian.Uint32(header[8:12])
+
+		body := make([]byte, int(valueLen)+int(keyLen))
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return err
+		}
+
+		// Deleted records, sniper's Backup skips them already
+		if header[1] == 42 {
+			continue
+		}
+
+		err = fn(body[valueLen:], body[:valueLen], expire)
+		if err != nil {
+			return err
+		}
+	}
+}
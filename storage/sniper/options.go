@@ -0,0 +1,59 @@
+package sniperstorage
+
+import (
+	"time"
+)
+
+// Option configures a Store in NewStore
+type Option func(*Store) error
+
+// ExpireInterval starts a background sweeper deleting expired keys and their index entries every interval,
+// default 0 (disabled). Expired keys are hidden from reads either way.
+func ExpireInterval(interval time.Duration) Option {
+	return func(s *Store) error {
+		s.expireInterval = interval
+		return nil
+	}
+}
+
+// IndexPath opens the index db at file instead of "<path>index-<dbName>.db"
+func IndexPath(file string) Option {
+	return func(s *Store) error {
+		s.indexFile = file
+		return nil
+	}
+}
+
+// ValueIndex keeps a value index (see storage.ValuesBucket) for bucketNames, so ValueExist and KeysByValue
+// work on them. NewStore builds it for buckets with data and drops it for buckets no longer passed.
+func ValueIndex(bucketNames ...string) Option {
+	return func(s *Store) error {
+		if s.valueIndexed == nil {
+			s.valueIndexed = map[string]bool{}
+		}
+
+		for _, name := range bucketNames {
+			s.valueIndexed[name] = true
+		}
+
+		return nil
+	}
+}
+
+// CompressBackups gzips every backup at level, gzip.DefaultCompression for 0. Restore detects it.
+func CompressBackups(level int) Option {
+	return func(s *Store) error {
+		s.backupOptions.Compress = true
+		s.backupOptions.Level = level
+		return s.backupOptions.Validate()
+	}
+}
+
+// EncryptBackups encrypts every backup with AES-GCM under key (16, 24 or 32 bytes).
+// Restore detects it and needs the same key.
+func EncryptBackups(key []byte) Option {
+	return func(s *Store) error {
+		s.backupOptions.Key = key
+		return s.backupOptions.Validate()
+	}
+}
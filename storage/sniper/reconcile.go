@@ -0,0 +1,245 @@
+package sniperstorage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ReconcileReport is what Reconcile found, and repaired unless DryRun. Keys are listed per bucket.
+type ReconcileReport struct {
+	DryRun    bool                `json:"dry_run"`
+	Orphans   map[string][]string `json:"orphans"`   // index keys whose data is gone
+	Unindexed map[string][]string `json:"unindexed"` // keys with data missing from their index
+	Expiries  map[string][]string `json:"expiries"`  // expiries of keys whose data is gone
+	Counts    map[string]int      `json:"counts"`    // catalog counts that were wrong, with the right count
+}
+
+// Clean reports whether the data and the index db matched
+func (r *ReconcileReport) Clean() bool {
+	return len(r.Orphans) == 0 && len(r.Unindexed) == 0 && len(r.Expiries) == 0 && len(r.Counts) == 0
+}
+
+// Reconcile checks the index db against the sniper data, which a crash between the two writes of a Set or
+// Delete leaves apart: it walks every sniper key and every index key, then removes index keys and expiries
+// whose data is gone, adds keys missing from their index and fixes the catalog counts. With dryRun it only
+// reports them. Expired keys are left to Expire. Every other call waits while it runs.
+func (s *Store) Reconcile(dryRun bool) (*ReconcileReport, error) {
+	if s.readOnly && !dryRun {
+		return nil, fmt.Errorf("reconcile: %w", storage.ErrReadOnly)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &ReconcileReport{
+		DryRun:    dryRun,
+		Orphans:   map[string][]string{},
+		Unindexed: map[string][]string{},
+		Expiries:  map[string][]string{},
+		Counts:    map[string]int{},
+	}
+
+	file := s.dir + ".reconcile"
+	_ = os.Remove(file)
+
+	err := s.db.Backup(file)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+	defer os.Remove(file)
+
+	counts := map[string]int{}
+	err = s.dbIndex.View(func(t *bolt.Tx) error {
+		// Sniper keys: count them, find the ones missing from their index
+		err := readBackup(file, func(key, _ []byte, _ uint32) error {
+			// Expired keys are counted with their expiry below
+			bucketName, k, ok := splitKey(key)
+			if !ok && s.legacyKeys {
+				bucketName, k, ok = s.splitOldKey(t, key)
+				ok = ok && len(bucketName) > 0
+			}
+
+			if !ok || !s.registry.Has(bucketName) || expired(t, bucketName, k) {
+				return nil
+			}
+
+			counts[string(bucketName)]++
+			if s.registry.IsIndex(bucketName) && t.Bucket(bucketName).Get(k) == nil {
+				r.Unindexed[string(bucketName)] = append(r.Unindexed[string(bucketName)], string(k))
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// Index keys and expiries whose data is gone
+		for _, indexName := range s.registry.Indexes() {
+			err = t.Bucket([]byte(indexName)).ForEach(func(k, _ []byte) error {
+				gone, err := s.gone(t, []byte(indexName), k)
+				if gone {
+					r.Orphans[indexName] = append(r.Orphans[indexName], string(k))
+				}
+
+				return err
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if root := t.Bucket(ttlBucket); root != nil {
+			err = root.ForEach(func(bucketName, _ []byte) error {
+				b := root.Bucket(bucketName)
+				if b == nil {
+					return nil
+				}
+
+				return b.ForEach(func(k, _ []byte) error {
+					gone, err := s.gone(t, bucketName, k)
+					if gone {
+						r.Expiries[string(bucketName)] = append(r.Expiries[string(bucketName)], string(k))
+					} else if err == nil && expired(t, bucketName, k) {
+						// Counted until swept
+						counts[string(bucketName)]++
+					}
+
+					return err
+				})
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		// An index counts its keys once repaired
+		catalog, err := storage.Catalog(t)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range catalog {
+			count := counts[info.Name]
+			if info.Is(storage.KindIndex) {
+				count = t.Bucket([]byte(info.Name)).Stats().KeyN - len(r.Orphans[info.Name]) + len(r.Unindexed[info.Name])
+			}
+
+			if info.Count != count {
+				r.Counts[info.Name] = count
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+
+	for _, keys := range []map[string][]string{r.Orphans, r.Unindexed, r.Expiries} {
+		for _, list := range keys {
+			sort.Strings(list)
+		}
+	}
+
+	if dryRun || r.Clean() {
+		return r, nil
+	}
+
+	err = s.dbIndex.Update(func(t *bolt.Tx) error {
+		return r.repair(t)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("reconcile: %w", err)
+	}
+
+	return r, nil
+}
+
+// gone reports whether the data of a key is gone while its expiry, if any, is not over yet
+func (s *Store) gone(t *bolt.Tx, bucketName []byte, k []byte) (bool, error) {
+	if expired(t, bucketName, k) {
+		return false, nil
+	}
+
+	_, err := s.lookup(bucketName, k)
+	if err == sniper.ErrNotFound {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// repair applies the report, repaired keys are logged for the next chain backup
+func (r *ReconcileReport) repair(t *bolt.Tx) error {
+	for indexName, keys := range r.Orphans {
+		for _, k := range keys {
+			err := t.Bucket([]byte(indexName)).Delete([]byte(k))
+			if err == nil {
+				err = storage.DeleteValue(t, []byte(indexName), []byte(k))
+			}
+
+			if err == nil {
+				err = storage.LogChange(t, []byte(indexName), []byte(k))
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for indexName, keys := range r.Unindexed {
+		for _, k := range keys {
+			err := t.Bucket([]byte(indexName)).Put([]byte(k), []byte(fmt.Sprint(0)))
+			if err == nil {
+				err = storage.LogChange(t, []byte(indexName), []byte(k))
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for bucketName, keys := range r.Expiries {
+		for _, k := range keys {
+			err := setExpiry(t, []byte(bucketName), []byte(k), 0)
+			if err == nil {
+				err = storage.DeleteValue(t, []byte(bucketName), []byte(k))
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, count := range r.Counts {
+		info, ok, err := storage.ReadBucketInfo(t, []byte(name))
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		info.Count = count
+		err = storage.WriteBucketInfo(t, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
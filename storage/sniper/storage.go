@@ -2,36 +2,68 @@ package sniperstorage
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"strings"
+	"hash/crc32"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
 
 	"github.com/recoilme/sniper"
 	bolt "go.etcd.io/bbolt"
 )
 
+var _ interfaces.Storage = (*Store)(nil)
+
 // Index: boltdb
 // Database: sniper - because of sniper memory index not working true
 type Store struct {
-	db         *sniper.Store
-	dbIndex    *bolt.DB
-	bucketList []string
-	readOnly   bool
-	indexList  []string
-	allBuckets []string
+	db       *sniper.Store
+	dbIndex  *bolt.DB
+	registry *storage.Registry
+	readOnly bool
+	txMu     sync.Mutex
+
+	// legacyKeys is set on read only stores of data in the first key format, see lookup
+	legacyKeys bool
+
+	// mu fences the store: every call holds it shared, Backup and Restore hold it
+	// exclusively so they see and replace the data and the index together
+	mu        sync.RWMutex
+	dir       string
+	indexFile string
+
+	expireInterval time.Duration
+	sweeperStop    chan struct{}
+	sweeperDone    chan struct{}
+
+	backupOptions storage.BackupOptions
+	valueIndexed  map[string]bool // buckets passed to ValueIndex
 }
 
-func NewStore(bucketList, indexList []string, path string, dbName string, readOnly bool) (*Store, error) {
+// NewStore opens the sniper data in "<path><dbName>" and its index db "<path>index-<dbName>.db" (see IndexPath),
+// so stores with different names can share a directory. Buckets and indexes created with
+// CreateBucket and CreateIndex are kept in the index db, reopening the store finds them without listing them again.
+func NewStore(bucketList, indexList []string, path string, dbName string, readOnly bool, opts ...Option) (*Store, error) {
 	s := &Store{}
-	s.bucketList = bucketList
 	s.readOnly = readOnly
-	s.indexList = indexList
-	s.allBuckets = append(bucketList, indexList...)
+	s.registry = storage.NewRegistry(bucketList, indexList)
+
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return s, err
+		}
+	}
 
 	// Open DB
-	db, err := sniper.Open(sniper.Dir(fmt.Sprintf("%s%s", path, dbName)))
+	s.dir = fmt.Sprintf("%s%s", path, dbName)
+	_, statErr := os.Stat(s.dir)
+	existed := statErr == nil
+
+	db, err := sniper.Open(sniper.Dir(s.dir))
 	if err != nil {
 		return s, err
 	}
@@ -43,37 +75,135 @@ func NewStore(bucketList, indexList []string, path string, dbName string, readOn
 	_ = storage.CreateDir(path)
 
 	// Open BoltDB
-	dbIndex, err := bolt.Open(fmt.Sprintf("%s%s.db", path, "indexstore"), 0600, &bolt.Options{ReadOnly: readOnly})
+	if s.indexFile == "" {
+		s.indexFile = fmt.Sprintf("%sindex-%s.db", path, dbName)
+	}
+
+	if existed && !readOnly {
+		err = migrateIndex(path, s.indexFile)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	dbIndex, err := s.openIndex()
 	if err != nil {
 		return s, err
 	}
 
-	if !readOnly {
+	s.dbIndex = dbIndex
+
+	err = s.migrateKeys()
+	if err != nil {
+		return s, err
+	}
+
+	err = s.recoverIntents()
+	if err != nil {
+		return s, err
+	}
+
+	err = s.syncValueIndexes()
+	if err != nil {
+		return s, err
+	}
+
+	if s.expireInterval > 0 && !readOnly {
+		s.sweeperStop = make(chan struct{})
+		s.sweeperDone = make(chan struct{})
+		go s.sweep()
+	}
+
+	return s, nil
+}
+
+// migrateIndex copies "<path>indexstore.db", the index db every store of a directory shared before
+// index files were named after the store, to indexFile when that does not exist yet. The old file stays
+// for the other stores of the directory; remove it once they all opened.
+func migrateIndex(path, indexFile string) error {
+	legacy := fmt.Sprintf("%s%s.db", path, "indexstore")
+	if legacy == indexFile {
+		return nil
+	}
+
+	if _, err := os.Stat(indexFile); !os.IsNotExist(err) {
+		return nil
+	}
+
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+
+	tmp := indexFile + ".tmp"
+	err := storage.CopyFile(legacy, tmp)
+	if err == nil {
+		err = os.Rename(tmp, indexFile)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("migrate index %s: %w", legacy, err)
+	}
+
+	return nil
+}
+
+// openIndex opens the index db, adds the buckets it registered to the store and creates the index buckets
+func (s *Store) openIndex() (*bolt.DB, error) {
+	dbIndex, err := bolt.Open(s.indexFile, 0600, &bolt.Options{ReadOnly: s.readOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	err = dbIndex.View(func(t *bolt.Tx) error {
+		return s.registry.Load(t)
+	})
+
+	if err == nil && !s.readOnly {
 		err = dbIndex.Update(func(t *bolt.Tx) error {
 			// Create Bucket
 			// Not necessary create bucket for sniper database
 
 			// Create Index
-			for _, indexName := range s.indexList {
+			for _, indexName := range s.registry.Indexes() {
 				_, err := t.CreateBucketIfNotExists([]byte(indexName))
 				if err != nil {
 					return err
 				}
 			}
 
-			return nil
+			names, err := s.uncatalogued(t)
+			if err != nil {
+				return err
+			}
+
+			err = s.registry.Save(t)
+			if err != nil {
+				return err
+			}
+
+			return seedCounts(t, names)
 		})
+	}
 
-		if err != nil {
-			return s, err
-		}
+	if err != nil {
+		_ = dbIndex.Close()
+		return nil, err
 	}
 
-	s.dbIndex = dbIndex
-	return s, nil
+	return dbIndex, nil
 }
 
 func (s *Store) CloseStore() error {
+	if s.sweeperStop != nil {
+		close(s.sweeperStop)
+		<-s.sweeperDone
+		s.sweeperStop = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	err := s.db.Close()
 	if err == nil {
 		err = s.dbIndex.Close()
@@ -83,51 +213,124 @@ func (s *Store) CloseStore() error {
 }
 
 func (s *Store) SyncStore() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	s.dbIndex.Sync()
 }
 
 func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.set(bucketName, k, v, 0)
+}
+
+// set writes a key expiring at expire (unix nano), 0 for no expiry
+func (s *Store) set(bucketName []byte, k []byte, v []byte, expire int64) ([]byte, error) {
 	if s.readOnly {
-		return nil, errors.New("readonly mod active")
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyKey)
 	}
 
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if len(v) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyValue)
 	}
 
-	if len(k) == 0 || len(v) == 0 {
-		return nil, errors.New("key or value not found")
+	key := dataKey(bucketName, k)
+
+	// Keys without bucket only live in sniper
+	if len(bucketName) == 0 {
+		seconds, _ := expireSeconds(expire)
+		return k, s.db.Set(key, v, seconds)
 	}
 
-	key := string(k)
-	if len(bucketName) > 0 {
-		key = string(bucketName) + key
+	id, err := s.journal(s.dbIndex.Update, &intent{
+		Op:     opSet,
+		Bucket: bucketName,
+		Keys:   []intentKey{{Key: k, Sum: crc32.ChecksumIEEE(v), Expire: expire}},
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	err := s.db.Set([]byte(key), v, 0)
-	if err == nil && storage.Contains(s.indexList, bucketName) {
-		err = s.dbIndex.Update(func(t *bolt.Tx) error {
+	seconds, expire := expireSeconds(expire)
+
+	// Inside the index transaction, so the bucket count sees one write at a time
+	err = s.dbIndex.Update(func(t *bolt.Tx) error {
+		counted, err := s.counted(t, bucketName, k)
+		if err != nil {
+			return err
+		}
+
+		err = s.db.Set(key, v, seconds)
+		if err != nil {
+			return err
+		}
+
+		if s.registry.IsIndex(bucketName) {
 			b := t.Bucket(bucketName)
 
-			return b.Put(k, []byte(fmt.Sprint(0)))
-		})
+			err := b.Put(k, []byte(fmt.Sprint(0)))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = storage.SetValue(t, bucketName, k, v)
+		if err != nil {
+			return err
+		}
+
+		if !counted {
+			err = storage.AddCount(t, bucketName, 1)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = storage.LogChange(t, bucketName, k)
+		if err != nil {
+			return err
+		}
+
+		err = setExpiry(t, bucketName, k, expire)
+		if err != nil {
+			return err
+		}
+
+		return settle(t, id)
+	})
+
+	if err != nil {
+		return k, s.abort(id, err)
 	}
 
-	return k, err
+	return k, nil
 }
 
 func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
-	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.get(bucketName, k)
+}
 
-	key := string(k)
-	if len(bucketName) > 0 {
-		key = string(bucketName) + key
+func (s *Store) get(bucketName []byte, k []byte) ([]byte, error) {
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("get %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	var item []byte
-	v, err := s.db.Get([]byte(key))
+	v, err := s.lookup(bucketName, k)
 	if err == sniper.ErrNotFound {
 		return item, nil
 	}
@@ -136,26 +339,22 @@ func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
 }
 
 func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("mget %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	items := make(map[string]interface{})
 
-	for _, k := range keys {
-		key := string(k)
-		if len(bucketName) > 0 {
-			key = string(bucketName) + key
+	for index, k := range keys {
+		v, err := s.lookup(bucketName, k)
+		if err != nil && err != sniper.ErrNotFound {
+			return nil, err
 		}
 
-		v, err := s.db.Get([]byte(key))
-		if err == sniper.ErrNotFound {
-			continue
-		} else if err != nil {
-			continue
-		}
-
-		items[key] = string(v)
+		items[fmt.Sprintf("%d:%s", index, k)] = string(v)
 	}
 
 	return items, nil
@@ -169,8 +368,11 @@ Next()   Move to the next key.
 Prev()   Move to the previous key.
 */
 func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("list %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	counter := 1
@@ -179,6 +381,10 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 
 	err = s.dbIndex.View(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
+		if b == nil {
+			return fmt.Errorf("list %s: bucket has no index: %w", bucketName, storage.ErrNotImplemented)
+		}
+
 		c := b.Cursor()
 
 		if len(k) > 0 {
@@ -187,10 +393,10 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 					continue
 				}
 
-				v, err := s.Get(bucketName, key)
-				if err == sniper.ErrNotFound {
-					continue
-				} else if err != nil {
+				v, err := s.item(bucketName, key)
+				if err != nil {
+					return err
+				} else if v == nil {
 					continue
 				}
 
@@ -205,10 +411,10 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 		} else {
 			for key, _ := c.First(); key != nil; key, _ = c.Next() {
 
-				v, err := s.Get(bucketName, key)
-				if err == sniper.ErrNotFound {
-					continue
-				} else if err != nil {
+				v, err := s.item(bucketName, key)
+				if err != nil {
+					return err
+				} else if v == nil {
 					continue
 				}
 
@@ -232,10 +438,12 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 	return items, err
 }
 
-// Not stable
 func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if !storage.Contains(s.allBuckets, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("prevlist %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	counter := 1
@@ -244,18 +452,28 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 
 	err = s.dbIndex.View(func(t *bolt.Tx) error {
 		b := t.Bucket(bucketName)
+		if b == nil {
+			return fmt.Errorf("prevlist %s: bucket has no index: %w", bucketName, storage.ErrNotImplemented)
+		}
+
 		c := b.Cursor()
 
 		if len(k) > 0 {
-			for key, _ := c.Seek(k); key != nil; key, _ = c.Prev() {
-				if bytes.Equal(key, k) {
+			// Seek lands on the first key >= cursor (or nowhere when the cursor is past the last key)
+			key, _ := c.Seek(k)
+			if key == nil {
+				key, _ = c.Last()
+			}
+
+			for ; key != nil; key, _ = c.Prev() {
+				if bytes.Compare(key, k) >= 0 {
 					continue
 				}
 
-				v, err := s.Get(bucketName, key)
-				if err == sniper.ErrNotFound {
-					continue
-				} else if err != nil {
+				v, err := s.item(bucketName, key)
+				if err != nil {
+					return err
+				} else if v == nil {
 					continue
 				}
 
@@ -270,10 +488,10 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 		} else {
 			for key, _ := c.Last(); key != nil; key, _ = c.Prev() {
 
-				v, err := s.Get(bucketName, key)
-				if err == sniper.ErrNotFound {
-					continue
-				} else if err != nil {
+				v, err := s.item(bucketName, key)
+				if err != nil {
+					return err
+				} else if v == nil {
 					continue
 				}
 
@@ -297,17 +515,94 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 	return items, nil
 }
 
-func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return false, errors.New("unknown bucket name")
+// item returns the list entry of an indexed key: its raw value, as sniperstorage always listed it. Index
+// keys whose data is gone return nil.
+func (s *Store) item(bucketName []byte, key []byte) ([]byte, error) {
+	return s.get(bucketName, key)
+}
+
+// Scan returns the items of the key range o selects (see storage.ScanOptions), seeking the index of the
+// bucket to its first key. Like List it needs an index bucket.
+func (s *Store) Scan(bucketName []byte, o storage.ScanOptions) ([]storage.KV, error) {
+	items := []storage.KV{}
+	err := s.scan("scan", bucketName, o, func(k, v []byte) {
+		items = append(items, storage.KV{Key: string(k), Value: string(v)})
+	})
+
+	return items, err
+}
+
+// Iterator streams the items of the key range o selects, storage.IteratorBatch items per transaction
+func (s *Store) Iterator(bucketName []byte, o storage.ScanOptions) (interfaces.Iterator, error) {
+	return s.iterator("iterator", bucketName, o)
+}
+
+// ForEach calls fn with every item of bucketName in key order until fn fails, outside any transaction so
+// fn can use the store. fn returning storage.ErrStop stops early without error.
+func (s *Store) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	it, err := s.iterator("foreach", bucketName, storage.ScanOptions{})
+	if err != nil {
+		return err
 	}
 
-	key := string(k)
-	if len(bucketName) > 0 {
-		key = string(bucketName) + key
+	return it.ForEach(fn)
+}
+
+func (s *Store) iterator(op string, bucketName []byte, o storage.ScanOptions) (*storage.BatchIterator, error) {
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	return storage.NewBatchIterator(o, storage.IteratorBatch, func(o storage.ScanOptions) ([]storage.Item, error) {
+		items := []storage.Item{}
+		err := s.scan(op, bucketName, o, func(k, v []byte) {
+			items = append(items, storage.Item{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+		})
+
+		return items, err
+	}), nil
+}
+
+// scan calls fn with the items of the range o selects, skipping index keys whose data is gone or expired
+func (s *Store) scan(op string, bucketName []byte, o storage.ScanOptions, fn func(k, v []byte)) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.registry.Has(bucketName) {
+		return fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	return s.dbIndex.View(func(t *bolt.Tx) error {
+		b := t.Bucket(bucketName)
+		if b == nil {
+			return fmt.Errorf("%s %s: bucket has no index: %w", op, bucketName, storage.ErrNotImplemented)
+		}
+
+		return o.Walk(b.Cursor(), func(k, _ []byte) (bool, error) {
+			v, err := s.get(bucketName, k)
+			if err != nil || len(v) == 0 {
+				return false, err
+			}
+
+			fn(k, v)
+			return true, nil
+		})
+	})
+}
+
+func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.keyExist(bucketName, k)
+}
+
+func (s *Store) keyExist(bucketName []byte, k []byte) (bool, error) {
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
+		return false, fmt.Errorf("keyexist %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
-	v, err := s.db.Get([]byte(key))
+	v, err := s.lookup(bucketName, k)
 	if err == sniper.ErrNotFound {
 		return false, nil
 	}
@@ -315,55 +610,174 @@ func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
 	return (len(v) > 0), err
 }
 
+// ValueExist reports whether a key of bucketName holds v. It needs the value index of the bucket (see ValueIndex),
+// sniper can not walk a bucket: without it the error wraps storage.ErrNotImplemented.
 func (s *Store) ValueExist(bucketName []byte, v []byte) (bool, error) {
-	return false, errors.New("not implemented")
+	keys, err := s.keysByValue("valueexist", bucketName, v, 1)
+	return len(keys) > 0, err
 }
 
 func (s *Store) Delete(bucketName []byte, k []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.delete(bucketName, k)
+}
+
+func (s *Store) delete(bucketName []byte, k []byte) error {
 	if s.readOnly {
-		return errors.New("readonly mod active")
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrReadOnly)
 	}
 
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return errors.New("unknown bucket name")
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
 	if len(k) == 0 {
-		return errors.New("key not found")
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrEmptyKey)
 	}
 
-	key := string(k)
-	if len(bucketName) > 0 {
-		key = string(bucketName) + key
+	key := dataKey(bucketName, k)
+
+	if len(bucketName) == 0 {
+		_, err := s.db.Delete(key)
+		return err
+	}
+
+	id, err := s.journal(s.dbIndex.Update, &intent{Op: opDelete, Bucket: bucketName, Keys: []intentKey{{Key: k}}})
+	if err != nil {
+		return err
 	}
 
-	_, err := s.db.Delete([]byte(key))
-	if err == nil && storage.Contains(s.indexList, bucketName) {
-		err = s.dbIndex.Update(func(t *bolt.Tx) error {
+	err = s.dbIndex.Update(func(t *bolt.Tx) error {
+		counted, err := s.counted(t, bucketName, k)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.db.Delete(key)
+		if err != nil {
+			return err
+		}
+
+		if s.registry.IsIndex(bucketName) {
 			b := t.Bucket(bucketName)
-			return b.Delete(k)
-		})
+
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = storage.DeleteValue(t, bucketName, k)
+		if err != nil {
+			return err
+		}
+
+		if counted {
+			err = storage.AddCount(t, bucketName, -1)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = storage.LogChange(t, bucketName, k)
+		if err != nil {
+			return err
+		}
+
+		err = setExpiry(t, bucketName, k, 0)
+		if err != nil {
+			return err
+		}
+
+		return settle(t, id)
+	})
+
+	if err != nil {
+		return s.abort(id, err)
 	}
 
-	return err
+	return nil
+}
+
+// CreateBucket adds a bucket at runtime, kept in the index db for the next NewStore.
+// Creating a bucket that already exists does nothing.
+func (s *Store) CreateBucket(bucketName []byte) error {
+	return s.create("createbucket", bucketName, storage.KindBucket)
+}
+
+// CreateIndex adds an index at runtime like CreateBucket
+func (s *Store) CreateIndex(indexName []byte) error {
+	return s.create("createindex", indexName, storage.KindIndex)
 }
 
+func (s *Store) create(op string, name []byte, kind storage.BucketKind) error {
+	if s.readOnly {
+		return fmt.Errorf("%s %s: %w", op, name, storage.ErrReadOnly)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	err := s.dbIndex.Update(func(t *bolt.Tx) error {
+		info, _, err := storage.ReadBucketInfo(t, name)
+		if err != nil {
+			return err
+		}
+
+		err = s.registry.Create(t, name, kind)
+		if err != nil {
+			return err
+		}
+
+		if s.valueIndexed[string(name)] {
+			err = storage.CreateValueIndex(t, name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if kind != storage.KindIndex || info.Is(kind) {
+			return nil
+		}
+
+		_, err = t.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+
+		// An index counts its indexed keys, keys the bucket had before are not
+		return seedCounts(t, []string{string(name)})
+	})
+
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", op, name, err)
+	}
+
+	s.registry.Add(name, kind)
+	return nil
+}
+
+// HasBucket reads the registry, loaded from the catalog on open and kept in step by CreateBucket
 func (s *Store) HasBucket(bucketName []byte) bool {
-	return len(bucketName) > 0 && storage.Contains(s.allBuckets, bucketName)
+	return len(bucketName) > 0 && s.registry.Has(bucketName)
 }
 
 func (s *Store) StatsBucket(bucketName []byte) int {
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
 		return 0
 	}
 
 	var stats int
 	err := s.dbIndex.View(func(t *bolt.Tx) error {
-		b := t.Bucket(bucketName)
+		info, _, err := storage.ReadBucketInfo(t, bucketName)
+		stats = info.Count
 
-		stats = b.Stats().KeyN // total count key/value
-
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -374,59 +788,70 @@ func (s *Store) StatsBucket(bucketName []byte) int {
 }
 
 func (s *Store) ListBucket() (buckets []string, err error) {
-	val, err := s.db.Get([]byte("[buckets]"))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bucketList := []string{}
+	err = s.dbIndex.View(func(t *bolt.Tx) error {
+		catalog, err := storage.Catalog(t)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range catalog {
+			if info.Is(storage.KindBucket) {
+				bucketList = append(bucketList, info.Name)
+			}
+		}
+
+		return nil
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
-	return strings.Split(string(val), ","), nil
+	return bucketList, nil
 }
 
 func (s *Store) DeleteBucket(bucketName []byte) error {
 	if s.readOnly {
-		return errors.New("readonly mod active")
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrReadOnly)
 	}
 
-	if len(bucketName) > 0 && !storage.Contains(s.allBuckets, bucketName) {
-		return errors.New("unknown bucket name")
+	if len(bucketName) > 0 && !s.registry.Has(bucketName) {
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrUnknownBucket)
 	}
 
-	if len(bucketName) > 0 {
-		err := s.dbIndex.View(func(t *bolt.Tx) error {
-			b := t.Bucket(bucketName)
-			c := b.Cursor()
+	if len(bucketName) == 0 || !s.registry.IsIndex(bucketName) {
+		// Keys of a bucket without index can not be listed
+		return fmt.Errorf("deletebucket %s: %w", bucketName, storage.ErrNotImplemented)
+	}
 
-			for key, _ := c.First(); key != nil; key, _ = c.Next() {
-				err := s.Delete(bucketName, key)
-				if err != nil {
-					return err
-				}
-			}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
+	// Collect keys first: Delete updates the index and can not run inside the View
+	keys := [][]byte{}
+	err := s.dbIndex.View(func(t *bolt.Tx) error {
+		b := t.Bucket(bucketName)
+
+		return b.ForEach(func(key, _ []byte) error {
+			keys = append(keys, append([]byte{}, key...))
 			return nil
 		})
+	})
 
+	if err != nil {
 		return err
 	}
 
-	return errors.New("not implemented")
-}
-
-func (s *Store) Backup(path, filename string) error {
-	// Create dir if necessary
-	_ = storage.CreateDir(path)
-
-	err := s.db.Backup(fmt.Sprintf("%s%s", path, filename))
-	if err == nil {
-		err = s.dbIndex.View(func(tx *bolt.Tx) error {
-
-			path = strings.TrimSuffix(path, "/") + "/index-" + filename + ".backup"
-			return tx.CopyFile(path, 0600)
-		})
+	for _, key := range keys {
+		err = s.delete(bucketName, key)
+		if err != nil {
+			return err
+		}
 	}
-	return err
-}
 
-func (s *Store) Restore(path, filename string) error {
-	return s.db.Restore(fmt.Sprintf("%s%s", path, filename))
+	return nil
 }
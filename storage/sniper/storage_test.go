@@ -2,10 +2,21 @@ package sniperstorage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+	"github.com/uretgec/mydb/storage/storagetest"
 
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestCmd(t *testing.T) {
@@ -37,5 +48,685 @@ func DeleteStore() error {
 		return err
 	}
 
-	return os.RemoveAll("./indexstore.db")
+	return os.RemoveAll("./index-storage_test.db")
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(bucketList, indexList []string, path, dbName string, readOnly bool) (interfaces.Storage, error) {
+		return NewStore(bucketList, indexList, path, dbName, readOnly, ValueIndex(append(bucketList, indexList...)...))
+	}, storagetest.RawLists)
+}
+
+func TestExpireInterval(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false, ExpireInterval(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), []byte("test_1"), []byte("number one"), time.Second)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	// The sweeper deletes the expired key from sniper and drops it from the posts index
+	assert.Eventually(t, func() bool {
+		return store.StatsBucket([]byte("posts")) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestRestore(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = store.Backup(path, "snapshot")
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	// Data and index both go back to the backup
+	err = store.Restore(path, "snapshot")
+	assert.NoError(t, err)
+
+	exist, err := store.KeyExist([]byte("posts"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, false, exist)
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	// A manifest that does not match leaves the store as it was
+	_, err = store.Set([]byte("posts"), []byte("test_3"), []byte("number three"))
+	assert.NoError(t, err)
+
+	m := &manifest{}
+	err = storage.ReadManifest(path+"snapshot.manifest", m)
+	assert.NoError(t, err)
+
+	m.Keys = 5
+	err = storage.WriteManifest(path+"snapshot.manifest", m)
+	assert.NoError(t, err)
+
+	err = store.Restore(path, "snapshot")
+	assert.Error(t, err)
+
+	res, err := store.Get([]byte("posts"), []byte("test_3"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, bytes.Equal(res, []byte("number three")))
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	// Backups without manifest are restored unchecked, past what an earlier restore left behind
+	assert.NoError(t, os.Remove(path+"snapshot.manifest"))
+	assert.NoError(t, os.MkdirAll(store.dir+".old", 0700))
+	assert.NoError(t, os.WriteFile(store.dir+".old/stale", []byte("stale"), 0600))
+
+	err = store.Restore(path, "snapshot")
+	assert.NoError(t, err)
+
+	exist, err = store.KeyExist([]byte("posts"), []byte("test_3"))
+	assert.NoError(t, err)
+	assert.Equal(t, false, exist)
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestBackupChain(t *testing.T) {
+	path := t.TempDir() + "/"
+	dir := path + "chain"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	set := func(k string) {
+		_, err := store.Set([]byte("posts"), []byte(k), []byte("value "+k))
+		assert.NoError(t, err)
+	}
+
+	exist := func(k string) bool {
+		exist, err := store.KeyExist([]byte("posts"), []byte(k))
+		assert.NoError(t, err)
+		return exist
+	}
+
+	set("a")
+	set("b")
+	b, err := store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.BackupFull, b.Kind) // a chain starts with a full backup
+
+	set("c")
+	assert.NoError(t, store.Delete([]byte("posts"), []byte("a")))
+	b, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.BackupIncremental, b.Kind)
+
+	set("d")
+	_, err = store.BackupChain(dir, storage.BackupDifferential)
+	assert.NoError(t, err)
+
+	set("e")
+	_, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+
+	set("f")
+
+	// Back to the first incremental
+	err = store.RestoreChain(dir, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true, false, false, false}, []bool{exist("a"), exist("b"), exist("c"), exist("d"), exist("e"), exist("f")})
+
+	// Up to the last one: full, differential, incremental
+	err = store.RestoreChain(dir, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true, true, true, false}, []bool{exist("a"), exist("b"), exist("c"), exist("d"), exist("e"), exist("f")})
+
+	// The changelog is gone after a restore, the chain goes on with a full backup
+	b, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.BackupFull, b.Kind)
+
+	// A changed file is caught before anything is restored
+	err = os.WriteFile(dir+"/000001-incremental.changes", []byte("changed"), 0600)
+	assert.NoError(t, err)
+
+	err = store.RestoreChain(dir, 1)
+	assert.Error(t, err)
+	assert.Equal(t, true, exist("e"))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	path := t.TempDir() + "/"
+	dir := path + "chain"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false, CompressBackups(0), EncryptBackups(bytes.Repeat([]byte("k"), 32)))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = store.Backup(path, "snapshot")
+	assert.NoError(t, err)
+
+	for _, file := range []string{path + "snapshot", path + "index-snapshot.backup"} {
+		encoded, err := storage.IsEncoded(file)
+		assert.NoError(t, err)
+		assert.Equal(t, true, encoded)
+	}
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	err = store.Restore(path, "snapshot")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	// Chains encode their change files as well
+	_, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	_, err = store.BackupChain(dir, storage.BackupIncremental)
+	assert.NoError(t, err)
+
+	encoded, err := storage.IsEncoded(dir + "/000001-incremental.changes")
+	assert.NoError(t, err)
+	assert.Equal(t, true, encoded)
+
+	err = store.RestoreChain(dir, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	var buf bytes.Buffer
+	err = store.BackupTo(&buf)
+	assert.NoError(t, err)
+
+	err = store.Delete([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+
+	err = store.RestoreFrom(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	other, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false)
+	assert.NoError(t, err)
+
+	err = other.Restore(path, "snapshot")
+	assert.Equal(t, true, errors.Is(err, storage.ErrBackupKey))
+
+	err = other.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestCatalog(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	// options has no index, sniper alone holds its keys
+	for _, k := range []string{"a", "b", "c"} {
+		_, err = store.Set([]byte("options"), []byte(k), []byte("value "+k))
+		assert.NoError(t, err)
+	}
+
+	_, err = store.Set([]byte("options"), []byte("a"), []byte("again"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Delete([]byte("options"), []byte("b")))
+	assert.NoError(t, store.Delete([]byte("options"), []byte("unknown")))
+	assert.Equal(t, 2, store.StatsBucket([]byte("options")))
+
+	err = store.MSet([]byte("posts"), map[string][]byte{"1": []byte("one"), "2": []byte("two")})
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), []byte("3"), []byte("three"), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, store.StatsBucket([]byte("posts")))
+
+	// Expired keys count until they are swept
+	assert.Eventually(t, func() bool {
+		exist, err := store.KeyExist([]byte("posts"), []byte("3"))
+		return err == nil && !exist
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 3, store.StatsBucket([]byte("posts")))
+	assert.NoError(t, store.Expire())
+	assert.Equal(t, 2, store.StatsBucket([]byte("posts")))
+
+	assert.NoError(t, store.CreateBucket([]byte("tenants")))
+
+	buckets, err := store.ListBucket()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"options", "pages", "posts", "tenants"}, buckets)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// The counts are kept in the index db
+	store, err = NewStore(nil, nil, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	catalog, err := store.Catalog()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(catalog))
+
+	counts := map[string]int{}
+	for _, info := range catalog {
+		counts[info.Name] = info.Count
+		assert.Equal(t, false, info.Created.IsZero())
+	}
+
+	assert.Equal(t, map[string]int{"options": 2, "pages": 0, "posts": 2, "tenants": 0}, counts)
+	assert.Equal(t, true, catalog[2].Is(storage.KindBucket) && catalog[2].Is(storage.KindIndex))
+
+	// A record that does not decode is reported, not read as an empty one
+	err = store.dbIndex.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storage.RegistryBucket).Put([]byte("options"), []byte("{"))
+	})
+	assert.NoError(t, err)
+
+	_, err = store.Catalog()
+	assert.Error(t, err)
+
+	_, err = store.ListBucket()
+	assert.Error(t, err)
+
+	_, err = store.Set([]byte("options"), []byte("d"), []byte("value d"))
+	assert.Error(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = NewStore(nil, nil, path, "storage_test", false)
+	assert.Error(t, err)
+	assert.NoError(t, store.db.Close())
+}
+
+func TestConcurrentBulkLoaders(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts", "pages"}, []string{"posts", "pages"}, t.TempDir()+"/", "storage_test", false)
+	assert.NoError(t, err)
+
+	// Two loaders write the same keys at once, every key is counted once
+	for _, bucketName := range []string{"options", "posts"} {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				loader, err := store.BulkLoader([]byte(bucketName), 5)
+				assert.NoError(t, err)
+
+				for k := 0; k < 100; k++ {
+					assert.NoError(t, loader.Add([]byte(fmt.Sprintf("key%03d", k)), []byte("value")))
+				}
+
+				assert.NoError(t, loader.Close())
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 100, store.StatsBucket([]byte(bucketName)), bucketName)
+	}
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestMigrateKeys(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"post", "posts"}, []string{"posts"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	// Data of the first key format: bucket name + key
+	for k, v := range map[string]string{"postabc": "plain", "posts1": "indexed", "hello": "no bucket"} {
+		assert.NoError(t, store.db.Set([]byte(k), []byte(v), 0))
+	}
+
+	err = store.dbIndex.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte("posts")).Put([]byte("1"), []byte("0"))
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteBucket(metaBucket)
+	})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Read only stores read the old keys as they are
+	store, err = NewStore([]string{"post", "posts"}, []string{"posts"}, path, "storage_test", true)
+	assert.NoError(t, err)
+
+	v, err := store.Get([]byte("posts"), []byte("1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "indexed", string(v))
+
+	exist, err := store.KeyExist([]byte("post"), []byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exist)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = NewStore([]string{"post", "posts"}, []string{"posts"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	get := func(bucketName, k string) string {
+		v, err := store.Get([]byte(bucketName), []byte(k))
+		assert.NoError(t, err)
+		return string(v)
+	}
+
+	assert.Equal(t, "plain", get("post", "abc"))
+	assert.Equal(t, "indexed", get("posts", "1"))
+	assert.Equal(t, "no bucket", get("", "hello"))
+	assert.Equal(t, 1, store.StatsBucket([]byte("post")))
+	assert.Equal(t, 3, store.db.Count())
+
+	// "post" "s1" and "posts" "1" no longer share a key
+	_, err = store.Set([]byte("post"), []byte("s1"), []byte("other"))
+	assert.NoError(t, err)
+	assert.Equal(t, "indexed", get("posts", "1"))
+	assert.Equal(t, "other", get("post", "s1"))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestMigrateAmbiguousKeys(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"post", "posts"}, nil, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	// "posts1" is "post" "s1" or "posts" "1", no index or expiry tells
+	for k, v := range map[string]string{"postabc": "plain", "posts1": "either"} {
+		assert.NoError(t, store.db.Set([]byte(k), []byte(v), 0))
+	}
+
+	err = store.dbIndex.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(metaBucket)
+	})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = NewStore([]string{"post", "posts"}, nil, path, "storage_test", false)
+	assert.Equal(t, true, errors.Is(err, ErrAmbiguousKeys))
+	assert.Equal(t, true, strings.Contains(err.Error(), "posts1"))
+	assert.Equal(t, false, strings.Contains(err.Error(), "postabc"))
+
+	// Nothing is rewritten
+	v, err := store.db.Get([]byte("postabc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(v))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestIndexFile(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	open := func(dbName string, opts ...Option) *Store {
+		store, err := NewStore([]string{"posts"}, []string{"posts"}, path, dbName, false, opts...)
+		assert.NoError(t, err)
+		return store
+	}
+
+	// Two stores in one directory keep their own index
+	one, two := open("one"), open("two")
+
+	_, err := one.Set([]byte("posts"), []byte("1"), []byte("one"))
+	assert.NoError(t, err)
+	_, err = two.Set([]byte("posts"), []byte("2"), []byte("two"))
+	assert.NoError(t, err)
+
+	for store, value := range map[*Store]string{one: "one", two: "two"} {
+		list, err := store.List([]byte("posts"), nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{value}, list)
+		assert.NoError(t, store.CloseStore())
+	}
+
+	_, err = os.Stat(path + "index-one.db")
+	assert.NoError(t, err)
+
+	// A store of the shared index file era gets a copy of it on first open
+	legacy := open("legacy", IndexPath(path+"indexstore.db"))
+	_, err = legacy.Set([]byte("posts"), []byte("3"), []byte("three"))
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.CloseStore())
+
+	legacy = open("legacy")
+	list, err := legacy.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.NoError(t, legacy.CloseStore())
+
+	_, err = os.Stat(path + "index-legacy.db")
+	assert.NoError(t, err)
+}
+
+func TestReconcile(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts"}, []string{"posts"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	for _, k := range []string{"1", "2", "3"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte("post "+k))
+		assert.NoError(t, err)
+	}
+
+	_, err = store.Set([]byte("options"), []byte("a"), []byte("value a"))
+	assert.NoError(t, err)
+
+	// Writes cut short between sniper and the index db
+	_, err = store.db.Delete(dataKey([]byte("posts"), []byte("2")))
+	assert.NoError(t, err)
+	assert.NoError(t, store.db.Set(dataKey([]byte("posts"), []byte("4")), []byte("post 4"), 0))
+	assert.NoError(t, store.db.Set(dataKey([]byte("options"), []byte("b")), []byte("value b"), 0))
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(list))
+
+	report, err := store.Reconcile(true)
+	assert.NoError(t, err)
+	assert.Equal(t, false, report.Clean())
+	assert.Equal(t, map[string][]string{"posts": {"2"}}, report.Orphans)
+	assert.Equal(t, map[string][]string{"posts": {"4"}}, report.Unindexed)
+	assert.Equal(t, map[string]int{"options": 2}, report.Counts)
+
+	// A dry run changes nothing
+	assert.Equal(t, 1, store.StatsBucket([]byte("options")))
+	report, err = store.Reconcile(true)
+	assert.NoError(t, err)
+	assert.Equal(t, false, report.Clean())
+
+	report, err = store.Reconcile(false)
+	assert.NoError(t, err)
+	assert.Equal(t, false, report.DryRun)
+	assert.Equal(t, map[string][]string{"posts": {"2"}}, report.Orphans)
+
+	list, err = store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, 3, store.StatsBucket([]byte("posts")))
+	assert.Equal(t, 2, store.StatsBucket([]byte("options")))
+
+	report, err = store.Reconcile(true)
+	assert.NoError(t, err)
+	assert.Equal(t, true, report.Clean())
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestRecoverIntents(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts"}, []string{"posts"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("1"), []byte("post 1"))
+	assert.NoError(t, err)
+	_, err = store.Set([]byte("options"), []byte("a"), []byte("value a"))
+	assert.NoError(t, err)
+
+	// Writes cut short after sniper was written
+	_, err = store.journal(store.dbIndex.Update, &intent{
+		Op:     opSet,
+		Bucket: []byte("posts"),
+		Keys:   []intentKey{{Key: []byte("2"), Sum: crc32.ChecksumIEEE([]byte("post 2"))}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.db.Set(dataKey([]byte("posts"), []byte("2")), []byte("post 2"), 0))
+
+	_, err = store.journal(store.dbIndex.Update, &intent{Op: opDelete, Bucket: []byte("posts"), Keys: []intentKey{{Key: []byte("1")}}})
+	assert.NoError(t, err)
+	_, err = store.db.Delete(dataKey([]byte("posts"), []byte("1")))
+	assert.NoError(t, err)
+
+	// and before
+	_, err = store.journal(store.dbIndex.Update, &intent{
+		Op:     opSet,
+		Bucket: []byte("options"),
+		Keys:   []intentKey{{Key: []byte("a"), Sum: crc32.ChecksumIEEE([]byte("new value a"))}},
+	})
+	assert.NoError(t, err)
+	_, err = store.journal(store.dbIndex.Update, &intent{Op: opDelete, Bucket: []byte("options"), Keys: []intentKey{{Key: []byte("a")}}})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = NewStore(nil, nil, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	v, err := store.Get([]byte("options"), []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "value a", string(v))
+	assert.Equal(t, 1, store.StatsBucket([]byte("options")))
+
+	report, err := store.Reconcile(true)
+	assert.NoError(t, err)
+	assert.Equal(t, true, report.Clean())
+
+	err = store.dbIndex.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 0, tx.Bucket(intentBucket).Stats().KeyN)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+}
+
+func TestValueIndex(t *testing.T) {
+	path := t.TempDir() + "/"
+
+	store, err := NewStore([]string{"options", "posts"}, []string{"posts"}, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	for k, v := range map[string]string{"1": "draft", "2": "published", "3": "draft"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(v))
+		assert.NoError(t, err)
+	}
+
+	_, err = store.ValueExist([]byte("posts"), []byte("draft"))
+	assert.Equal(t, true, errors.Is(err, storage.ErrNotImplemented))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Built for the data already there
+	store, err = NewStore(nil, nil, path, "storage_test", false, ValueIndex("posts", "options", "tenants"))
+	assert.NoError(t, err)
+
+	keys, err := store.KeysByValue([]byte("posts"), []byte("draft"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "3"}, keys)
+
+	_, err = store.Set([]byte("posts"), []byte("3"), []byte("published"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Delete([]byte("posts"), []byte("2")))
+
+	keys, err = store.KeysByValue([]byte("posts"), []byte("published"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3"}, keys)
+
+	err = store.MSet([]byte("options"), map[string][]byte{"a": []byte("on"), "b": []byte("off")})
+	assert.NoError(t, err)
+
+	exists, err := store.ValueExist([]byte("options"), []byte("on"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+
+	_, err = store.SetWithTTL([]byte("options"), []byte("c"), []byte("soon"), time.Second)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.CreateBucket([]byte("tenants")))
+	_, err = store.Set([]byte("tenants"), []byte("42"), []byte("acme"))
+	assert.NoError(t, err)
+
+	exists, err = store.ValueExist([]byte("tenants"), []byte("acme"))
+	assert.NoError(t, err)
+	assert.Equal(t, true, exists)
+
+	// Expired keys are gone from the value index too
+	assert.Eventually(t, func() bool {
+		exists, err := store.ValueExist([]byte("options"), []byte("soon"))
+		return err == nil && !exists
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, store.Expire())
+
+	err = store.dbIndex.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 0, len(storage.ValueKeys(tx, []byte("options"), []byte("soon"))))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Dropped once no longer asked for
+	store, err = NewStore(nil, nil, path, "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.KeysByValue([]byte("posts"), []byte("draft"))
+	assert.Equal(t, true, errors.Is(err, storage.ErrNotImplemented))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
 }
@@ -0,0 +1,216 @@
+package sniperstorage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ttlBucket lives in the index db and holds one nested bucket per data bucket, mapping key -> expiry (unix nano).
+// Sniper expires keys itself with second precision, the recorded expiry is rounded the same way.
+var ttlBucket = []byte("[ttl]")
+
+// SetWithTTL writes like Set, the key expires after ttl (rounded up to the next second)
+func (s *Store) SetWithTTL(bucketName []byte, k []byte, v []byte, ttl time.Duration) ([]byte, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("setwithttl %s: invalid ttl %s", bucketName, ttl)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.set(bucketName, k, v, time.Now().Add(ttl).UnixNano())
+}
+
+// TTL returns the time left before the key expires, 0 for a key without expiry.
+// Missing or expired keys return storage.ErrNotFound.
+func (s *Store) TTL(bucketName []byte, k []byte) (time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	exists, err := s.keyExist(bucketName, k)
+	if err != nil {
+		return 0, err
+	}
+
+	if !exists {
+		return 0, fmt.Errorf("ttl %s: %w", bucketName, storage.ErrNotFound)
+	}
+
+	var ttl time.Duration
+	err = s.dbIndex.View(func(t *bolt.Tx) error {
+		if expire := expiry(t, bucketName, k); expire > 0 {
+			ttl = time.Until(time.Unix(0, expire))
+		}
+
+		return nil
+	})
+
+	return ttl, err
+}
+
+// Expire deletes every expired key and its index entry, the sweeper started by ExpireInterval calls it
+func (s *Store) Expire() error {
+	if s.readOnly {
+		return fmt.Errorf("expire: %w", storage.ErrReadOnly)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+
+	found := map[string][][]byte{}
+	err := s.dbIndex.View(func(t *bolt.Tx) error {
+		root := t.Bucket(ttlBucket)
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(bucketName, _ []byte) error {
+			return root.Bucket(bucketName).ForEach(func(k, v []byte) error {
+				if int64(storage.Btou64(v)) <= now {
+					found[string(bucketName)] = append(found[string(bucketName)], append([]byte{}, k...))
+				}
+
+				return nil
+			})
+		})
+	})
+
+	if err != nil || len(found) == 0 {
+		return err
+	}
+
+	return s.dbIndex.Update(func(t *bolt.Tx) error {
+		for bucketName, keys := range found {
+			for _, k := range keys {
+				// Skip keys written again since
+				if !expired(t, []byte(bucketName), k) {
+					continue
+				}
+
+				// Sniper already hides them, delete drops the data for good
+				_, err := s.db.Delete(dataKey([]byte(bucketName), k))
+				if err != nil {
+					return err
+				}
+
+				err = storage.AddCount(t, []byte(bucketName), -1)
+				if err != nil {
+					return err
+				}
+
+				if b := t.Bucket([]byte(bucketName)); b != nil && s.registry.IsIndex([]byte(bucketName)) {
+					err := b.Delete(k)
+					if err != nil {
+						return err
+					}
+				}
+
+				err = storage.DeleteValue(t, []byte(bucketName), k)
+				if err != nil {
+					return err
+				}
+
+				err = storage.LogChange(t, []byte(bucketName), k)
+				if err != nil {
+					return err
+				}
+
+				err = setExpiry(t, []byte(bucketName), k, 0)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// sweep runs Expire every expireInterval until CloseStore
+func (s *Store) sweep() {
+	defer close(s.sweeperDone)
+
+	ticker := time.NewTicker(s.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.Expire()
+		case <-s.sweeperStop:
+			return
+		}
+	}
+}
+
+// expireSeconds converts an expiry to the unix second sniper stores. Sniper keeps a key
+// until that second is over, so the effective expiry is the start of the next second.
+func expireSeconds(expire int64) (uint32, int64) {
+	if expire == 0 {
+		return 0, 0
+	}
+
+	seconds := expire / int64(time.Second)
+
+	return uint32(seconds), (seconds + 1) * int64(time.Second)
+}
+
+// expiry returns the expiry of a key, 0 if it has none
+func expiry(t *bolt.Tx, bucketName []byte, k []byte) int64 {
+	root := t.Bucket(ttlBucket)
+	if root == nil || len(bucketName) == 0 {
+		return 0
+	}
+
+	b := root.Bucket(bucketName)
+	if b == nil {
+		return 0
+	}
+
+	v := b.Get(k)
+	if v == nil {
+		return 0
+	}
+
+	return int64(storage.Btou64(v))
+}
+
+func expired(t *bolt.Tx, bucketName []byte, k []byte) bool {
+	expire := expiry(t, bucketName, k)
+
+	return expire > 0 && expire <= time.Now().UnixNano()
+}
+
+// setExpiry records the expiry of a key, 0 clears it. Keys without bucket only use sniper's own expiry.
+func setExpiry(t *bolt.Tx, bucketName []byte, k []byte, expire int64) error {
+	if len(bucketName) == 0 {
+		return nil
+	}
+
+	root := t.Bucket(ttlBucket)
+	if expire == 0 {
+		if root == nil || root.Bucket(bucketName) == nil {
+			return nil
+		}
+
+		return root.Bucket(bucketName).Delete(k)
+	}
+
+	root, err := t.CreateBucketIfNotExists(ttlBucket)
+	if err != nil {
+		return err
+	}
+
+	b, err := root.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, storage.U64tob(int(expire)))
+}
@@ -0,0 +1,245 @@
+package sniperstorage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// tx journals writes and applies them to sniper and the index on commit.
+// Sniper has no transactions, so this is best effort: a failed commit is undone
+// with the values read before each write, but a crash in the middle of a commit is not.
+type tx struct {
+	s        *Store
+	writable bool
+	journal  []entry
+	pending  map[string]entry
+}
+
+// entry is one journaled write, value is nil for a delete
+type entry struct {
+	bucketName []byte
+	key        []byte
+	value      []byte
+}
+
+func (e *entry) id() string {
+	return fmt.Sprintf("%d:%s%s", len(e.bucketName), e.bucketName, e.key)
+}
+
+func (s *Store) Update(fn func(tx interfaces.Tx) error) error {
+	if s.readOnly {
+		return fmt.Errorf("update: %w", storage.ErrReadOnly)
+	}
+
+	// One transaction at a time, so commits do not interleave
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := &tx{s: s, writable: true, pending: make(map[string]entry)}
+
+	err := fn(t)
+	if err != nil {
+		return err
+	}
+
+	return t.commit()
+}
+
+func (s *Store) View(fn func(tx interfaces.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&tx{s: s})
+}
+
+// commit applies the journal in order, undoing the applied part when a write fails
+func (tx *tx) commit() error {
+	applied := []entry{}
+
+	for _, e := range tx.journal {
+		before, err := tx.s.get(e.bucketName, e.key)
+		if err == nil {
+			err = tx.apply(e)
+		}
+
+		if err != nil {
+			for i := len(applied) - 1; i >= 0; i-- {
+				_ = tx.apply(applied[i])
+			}
+
+			return err
+		}
+
+		applied = append(applied, entry{bucketName: e.bucketName, key: e.key, value: before})
+	}
+
+	return nil
+}
+
+func (tx *tx) apply(e entry) error {
+	if e.value == nil {
+		return tx.s.delete(e.bucketName, e.key)
+	}
+
+	_, err := tx.s.set(e.bucketName, e.key, e.value, 0)
+	return err
+}
+
+func (tx *tx) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("get %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	// Reads see the transaction's own writes
+	if e, ok := tx.pending[(&entry{bucketName: bucketName, key: k}).id()]; ok {
+		return e.value, nil
+	}
+
+	return tx.s.get(bucketName, k)
+}
+
+func (tx *tx) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
+	if !tx.writable {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyKey)
+	}
+
+	if len(v) == 0 {
+		return nil, fmt.Errorf("set %s: %w", bucketName, storage.ErrEmptyValue)
+	}
+
+	tx.write(entry{
+		bucketName: append([]byte{}, bucketName...),
+		key:        append([]byte{}, k...),
+		value:      append([]byte{}, v...),
+	})
+
+	return k, nil
+}
+
+func (tx *tx) Delete(bucketName []byte, k []byte) error {
+	if !tx.writable {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrReadOnly)
+	}
+
+	if !tx.s.registry.Has(bucketName) {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if len(k) == 0 {
+		return fmt.Errorf("delete %s: %w", bucketName, storage.ErrEmptyKey)
+	}
+
+	tx.write(entry{
+		bucketName: append([]byte{}, bucketName...),
+		key:        append([]byte{}, k...),
+	})
+
+	return nil
+}
+
+func (tx *tx) write(e entry) {
+	tx.journal = append(tx.journal, e)
+	tx.pending[e.id()] = e
+}
+
+// Cursor walks the index keys of the bucket as of the call, merged with the transaction's own writes.
+// Buckets without index can not be walked.
+func (tx *tx) Cursor(bucketName []byte) (interfaces.Cursor, error) {
+	if !tx.s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("cursor %s: %w", bucketName, storage.ErrUnknownBucket)
+	}
+
+	if !tx.s.registry.IsIndex(bucketName) {
+		return nil, fmt.Errorf("cursor %s: bucket has no index: %w", bucketName, storage.ErrNotImplemented)
+	}
+
+	keys := map[string]bool{}
+	err := tx.s.dbIndex.View(func(t *bolt.Tx) error {
+		return t.Bucket(bucketName).ForEach(func(key, _ []byte) error {
+			keys[string(key)] = true
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range tx.journal {
+		if bytes.Equal(e.bucketName, bucketName) {
+			keys[string(e.key)] = e.value != nil
+		}
+	}
+
+	c := &cursor{tx: tx, bucketName: bucketName, pos: -1}
+	for key, exists := range keys {
+		if exists {
+			c.keys = append(c.keys, key)
+		}
+	}
+	sort.Strings(c.keys)
+
+	return c, nil
+}
+
+// cursor walks a sorted key snapshot and reads values through the transaction
+type cursor struct {
+	tx         *tx
+	bucketName []byte
+	keys       []string
+	pos        int
+}
+
+func (c *cursor) at(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.keys) {
+		c.pos = len(c.keys)
+		if i < 0 {
+			c.pos = -1
+		}
+
+		return nil, nil
+	}
+
+	c.pos = i
+	key := []byte(c.keys[i])
+	v, _ := c.tx.Get(c.bucketName, key)
+
+	return key, v
+}
+
+func (c *cursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *cursor) Last() ([]byte, []byte) {
+	return c.at(len(c.keys) - 1)
+}
+
+func (c *cursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.keys, string(seek)))
+}
+
+func (c *cursor) Next() ([]byte, []byte) {
+	return c.at(c.pos + 1)
+}
+
+func (c *cursor) Prev() ([]byte, []byte) {
+	return c.at(c.pos - 1)
+}
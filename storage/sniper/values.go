@@ -0,0 +1,136 @@
+package sniperstorage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/uretgec/mydb/storage"
+
+	"github.com/recoilme/sniper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KeysByValue returns the keys of bucketName holding v, sorted. Like ValueExist it needs the value index of the bucket.
+func (s *Store) KeysByValue(bucketName []byte, v []byte) ([]string, error) {
+	return s.keysByValue("keysbyvalue", bucketName, v, 0)
+}
+
+// keysByValue returns up to limit keys holding v, 0 for all
+func (s *Store) keysByValue(op string, bucketName []byte, v []byte, limit int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.registry.Has(bucketName) {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, storage.ErrUnknownBucket)
+	}
+
+	keys := []string{}
+	err := s.dbIndex.View(func(t *bolt.Tx) error {
+		if !storage.HasValueIndex(t, bucketName) {
+			return storage.ErrNotImplemented
+		}
+
+		// Hashes may collide, the values decide
+		for _, k := range storage.ValueKeys(t, bucketName, v) {
+			if expired(t, bucketName, k) {
+				continue
+			}
+
+			value, err := s.lookup(bucketName, k)
+			if err == sniper.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if bytes.Equal(value, v) {
+				keys = append(keys, string(k))
+			}
+
+			if limit > 0 && len(keys) >= limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", op, bucketName, err)
+	}
+
+	return keys, nil
+}
+
+// syncValueIndexes drops the value indexes of buckets no longer passed to ValueIndex, then builds the
+// missing ones from a sniper backup in the same transaction. NewStore and Restore call it.
+func (s *Store) syncValueIndexes() error {
+	if s.readOnly {
+		return nil
+	}
+
+	build := map[string]bool{}
+	err := s.dbIndex.View(func(t *bolt.Tx) error {
+		for name := range s.valueIndexed {
+			if s.registry.Has([]byte(name)) && !storage.HasValueIndex(t, []byte(name)) {
+				build[name] = true
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	file := s.dir + ".values"
+	backup := len(build) > 0 && s.db.Count() > 0
+	if backup {
+		_ = os.Remove(file)
+
+		err = s.db.Backup(file)
+		if err != nil {
+			return fmt.Errorf("value index: %w", err)
+		}
+		defer os.Remove(file)
+	}
+
+	err = s.dbIndex.Update(func(t *bolt.Tx) error {
+		for _, name := range storage.ValueIndexes(t) {
+			if !s.valueIndexed[name] {
+				err := storage.DropValueIndex(t, []byte(name))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for name := range build {
+			err := storage.CreateValueIndex(t, []byte(name))
+			if err != nil {
+				return err
+			}
+		}
+
+		if !backup {
+			return nil
+		}
+
+		return readBackup(file, func(key, value []byte, _ uint32) error {
+			bucketName, k, ok := splitKey(key)
+			if !ok || !build[string(bucketName)] {
+				return nil
+			}
+
+			return storage.SetValue(t, bucketName, k, value)
+		})
+	})
+
+	if err != nil {
+		return fmt.Errorf("value index: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,1112 @@
+// Package storagetest is a conformance suite for interfaces.Storage.
+//
+// Every backend runs the same suite from its own tests, so behavioral drift
+// between boltdbstorage and sniperstorage is caught automatically:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(bucketList, indexList []string, path, dbName string, readOnly bool) (interfaces.Storage, error) {
+//			return NewStore(bucketList, indexList, path, dbName, readOnly)
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uretgec/mydb/storage"
+	"github.com/uretgec/mydb/storage/interfaces"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory opens a store the same way the backend's NewStore does.
+type Factory func(bucketList, indexList []string, path string, dbName string, readOnly bool) (interfaces.Storage, error)
+
+// Bucket and index lists every store is opened with
+var (
+	Buckets = []string{"options", "posts", "pages"}
+	Indexes = []string{"posts", "pages"}
+)
+
+const dbName = "storagetest"
+
+// RawLists, passed with the skipped subtests, records a known backend difference: List and PrevList
+// return the raw values of an index bucket instead of storage.KV items. sniperstorage kept the output
+// it always had. The suite then checks each value against the key Scan finds at its place.
+const RawLists = "RawLists"
+
+// Run executes the whole suite against the backend returned by open.
+// Subtests named in skip are skipped, so a backend can opt out of a
+// behavior it does not implement yet.
+func Run(t *testing.T, open Factory, skip ...string) {
+	if storage.Contains(skip, []byte(RawLists)) {
+		open = rawLists(open)
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, open Factory)
+	}{
+		{"SetGet", testSetGet},
+		{"MGet", testMGet},
+		{"List", testList},
+		{"PrevList", testPrevList},
+		{"Scan", testScan},
+		{"Iterator", testIterator},
+		{"ForEach", testForEach},
+		{"Delete", testDelete},
+		{"TTL", testTTL},
+		{"MSet", testMSet},
+		{"BulkLoader", testBulkLoader},
+		{"BulkLoaderConcurrent", testBulkLoaderConcurrent},
+		{"Update", testUpdate},
+		{"UpdateRollback", testUpdateRollback},
+		{"View", testView},
+		{"Cursor", testCursor},
+		{"KeyExist", testKeyExist},
+		{"ValueExist", testValueExist},
+		{"KeysByValue", testKeysByValue},
+		{"Buckets", testBuckets},
+		{"CreateBucket", testCreateBucket},
+		{"ListBucket", testListBucket},
+		{"DeleteBucket", testDeleteBucket},
+		{"ReadOnly", testReadOnly},
+		{"BackupRestore", testBackupRestore},
+		{"BackupToRestoreFrom", testBackupToRestoreFrom},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if storage.Contains(skip, []byte(tt.name)) {
+				t.Skipf("%s is not supported by this backend", tt.name)
+			}
+
+			tt.fn(t, open)
+		})
+	}
+}
+
+// rawLists wraps the stores of open so List and PrevList return storage.KV items again: the raw values
+// are matched with the keys Scan returns for the same page.
+func rawLists(open Factory) Factory {
+	return func(bucketList, indexList []string, path string, dbName string, readOnly bool) (interfaces.Storage, error) {
+		store, err := open(bucketList, indexList, path, dbName, readOnly)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rawListStore{store}, nil
+	}
+}
+
+type rawListStore struct {
+	interfaces.Storage
+}
+
+func (s *rawListStore) List(bucketName []byte, cursor []byte, perpage int) ([]string, error) {
+	values, err := s.Storage.List(bucketName, cursor, perpage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start is included, the cursor is not
+	kvs, err := s.Scan(bucketName, storage.ScanOptions{Start: cursor, Limit: perpage + 1})
+	if len(kvs) > 0 && len(cursor) > 0 && kvs[0].Key == string(cursor) {
+		kvs = kvs[1:]
+	}
+
+	return s.items(values, kvs, perpage, err)
+}
+
+func (s *rawListStore) PrevList(bucketName []byte, cursor []byte, perpage int) ([]string, error) {
+	values, err := s.Storage.PrevList(bucketName, cursor, perpage)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs, err := s.Scan(bucketName, storage.ScanOptions{End: cursor, Reverse: true, Limit: perpage})
+	return s.items(values, kvs, perpage, err)
+}
+
+// items pairs the listed values with the scanned keys, a value that does not match is an error
+func (s *rawListStore) items(values []string, kvs []storage.KV, perpage int, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if len(kvs) > perpage {
+		kvs = kvs[:perpage]
+	}
+
+	if len(values) != len(kvs) {
+		return nil, fmt.Errorf("listed %d values, scanned %d keys", len(values), len(kvs))
+	}
+
+	items := []string{}
+	for i, v := range values {
+		if v != kvs[i].Value {
+			return nil, fmt.Errorf("listed %q, scanned %q at %s", v, kvs[i].Value, kvs[i].Key)
+		}
+
+		item, err := kvs[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, string(item))
+	}
+
+	return items, nil
+}
+
+// openStore opens a writable store in a fresh directory and closes it when the test ends.
+func openStore(t *testing.T, open Factory) interfaces.Storage {
+	t.Helper()
+
+	return openStoreAt(t, open, dir(t), false)
+}
+
+func openStoreAt(t *testing.T, open Factory, path string, readOnly bool) interfaces.Storage {
+	t.Helper()
+
+	store, err := open(Buckets, Indexes, path, dbName, readOnly)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = store.CloseStore()
+	})
+
+	return store
+}
+
+// dir returns a temporary directory in the "path/" form NewStore expects.
+func dir(t *testing.T) string {
+	return t.TempDir() + "/"
+}
+
+// fill writes n items to bucketName with keys key01..keyNN and values value01..valueNN.
+func fill(t *testing.T, store interfaces.Storage, bucketName string, n int) {
+	t.Helper()
+
+	for i := 1; i <= n; i++ {
+		_, err := store.Set([]byte(bucketName), key(i), value(i))
+		require.NoError(t, err)
+	}
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%02d", i))
+}
+
+func value(i int) []byte {
+	return []byte(fmt.Sprintf("value%02d", i))
+}
+
+// assertIs checks err wraps target, like errors.Is
+func assertIs(t *testing.T, err error, target error) bool {
+	t.Helper()
+
+	return assert.Truef(t, errors.Is(err, target), "expected %v, got %v", target, err)
+}
+
+// keysOf decodes the storage.KV items an index bucket List/PrevList returns.
+func keysOf(t *testing.T, items []string) []string {
+	t.Helper()
+
+	keys := []string{}
+	for _, item := range items {
+		kv := storage.KV{}
+		require.NoError(t, kv.UnmarshalBinary([]byte(item)))
+
+		keys = append(keys, kv.Key)
+	}
+
+	return keys
+}
+
+func testSetGet(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	k, err := store.Set([]byte("posts"), []byte("post_1"), []byte("number one"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("post_1"), k)
+
+	v, err := store.Get([]byte("posts"), []byte("post_1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("number one"), v)
+
+	// Overwrite
+	_, err = store.Set([]byte("posts"), []byte("post_1"), []byte("number one updated"))
+	require.NoError(t, err)
+
+	v, err = store.Get([]byte("posts"), []byte("post_1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("number one updated"), v)
+
+	// Buckets do not share keys
+	v, err = store.Get([]byte("pages"), []byte("post_1"))
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	// Missing key is not an error
+	v, err = store.Get([]byte("posts"), []byte("missing"))
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	_, err = store.Set([]byte("unknown"), []byte("post_1"), []byte("number one"))
+	assertIs(t, err, storage.ErrUnknownBucket)
+
+	_, err = store.Get([]byte("unknown"), []byte("post_1"))
+	assertIs(t, err, storage.ErrUnknownBucket)
+
+	_, err = store.Set([]byte("posts"), []byte("post_2"), nil)
+	assertIs(t, err, storage.ErrEmptyValue)
+}
+
+func testMGet(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 3)
+
+	items, err := store.MGet([]byte("posts"), key(1), key(3), []byte("missing"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"0:key01":   "value01",
+		"1:key03":   "value03",
+		"2:missing": "",
+	}, items)
+
+	_, err = store.MGet([]byte("unknown"), key(1))
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testList(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 10)
+
+	tests := []struct {
+		name    string
+		cursor  []byte
+		perpage int
+		want    []string
+	}{
+		{"first page", nil, 3, []string{"key01", "key02", "key03"}},
+		{"next page", key(3), 3, []string{"key04", "key05", "key06"}},
+		{"last page is short", key(8), 3, []string{"key09", "key10"}},
+		{"cursor at last key", key(10), 3, []string{}},
+		{"cursor between keys", []byte("key035"), 2, []string{"key04", "key05"}},
+		{"cursor before first key", []byte("a"), 2, []string{"key01", "key02"}},
+		{"cursor after last key", []byte("z"), 2, []string{}},
+		{"perpage larger than bucket", nil, 20, []string{"key01", "key02", "key03", "key04", "key05", "key06", "key07", "key08", "key09", "key10"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := store.List([]byte("posts"), tt.cursor, tt.perpage)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, keysOf(t, items))
+		})
+	}
+
+	items, err := store.List([]byte("pages"), nil, 10)
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	_, err = store.List([]byte("unknown"), nil, 10)
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testPrevList(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 10)
+
+	tests := []struct {
+		name    string
+		cursor  []byte
+		perpage int
+		want    []string
+	}{
+		{"first page", nil, 3, []string{"key10", "key09", "key08"}},
+		{"next page", key(8), 3, []string{"key07", "key06", "key05"}},
+		{"last page is short", key(3), 3, []string{"key02", "key01"}},
+		{"cursor at first key", key(1), 3, []string{}},
+		{"cursor between keys", []byte("key055"), 2, []string{"key05", "key04"}},
+		{"cursor before first key", []byte("a"), 2, []string{}},
+		{"cursor after last key", []byte("z"), 2, []string{"key10", "key09"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := store.PrevList([]byte("posts"), tt.cursor, tt.perpage)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, keysOf(t, items))
+		})
+	}
+
+	items, err := store.PrevList([]byte("pages"), nil, 10)
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	_, err = store.PrevList([]byte("unknown"), nil, 10)
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testScan(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	for _, k := range []string{"post:1", "user:1:a", "user:1:b", "user:10:a", "user:2:a", "user:2:b"} {
+		_, err := store.Set([]byte("posts"), []byte(k), []byte("value "+k))
+		require.NoError(t, err)
+	}
+
+	keys := func(o storage.ScanOptions) []string {
+		t.Helper()
+
+		items, err := store.Scan([]byte("posts"), o)
+		require.NoError(t, err)
+
+		list := []string{}
+		for _, item := range items {
+			assert.Equal(t, "value "+item.Key, item.Value)
+			list = append(list, item.Key)
+		}
+
+		return list
+	}
+
+	assert.Equal(t, []string{"user:1:a", "user:1:b"}, keys(storage.ScanOptions{Prefix: []byte("user:1:")}))
+	assert.Equal(t, []string{"user:1:b", "user:1:a"}, keys(storage.ScanOptions{Prefix: []byte("user:1:"), Reverse: true}))
+	// "user:10:a" sorts before "user:1:a"
+	assert.Equal(t, []string{"user:10:a", "user:1:a", "user:1:b"}, keys(storage.ScanOptions{Prefix: []byte("user:1")}))
+	assert.Equal(t, []string{"user:1:a", "user:1:b", "user:2:a"}, keys(storage.ScanOptions{Start: []byte("user:1:"), End: []byte("user:2:b")}))
+	assert.Equal(t, []string{"user:1:a", "user:1:b", "user:2:a", "user:2:b"}, keys(storage.ScanOptions{Start: []byte("user:1:"), End: []byte("user:2:b"), Inclusive: true}))
+	assert.Equal(t, []string{"user:2:b", "user:2:a", "user:1:b", "user:1:a"}, keys(storage.ScanOptions{Start: []byte("user:1:"), End: []byte("user:2:b"), Inclusive: true, Reverse: true}))
+	assert.Equal(t, []string{"user:2:a", "user:1:b", "user:1:a"}, keys(storage.ScanOptions{Start: []byte("user:1:"), End: []byte("user:2:b"), Reverse: true}))
+	assert.Equal(t, []string{"user:1:a", "user:1:b"}, keys(storage.ScanOptions{Prefix: []byte("user:1"), Start: []byte("user:1:")}))
+	assert.Equal(t, []string{"post:1", "user:10:a"}, keys(storage.ScanOptions{Limit: 2}))
+	assert.Equal(t, []string{"user:2:b", "user:2:a"}, keys(storage.ScanOptions{Prefix: []byte("user:"), Reverse: true, Limit: 2}))
+	assert.Equal(t, []string{}, keys(storage.ScanOptions{Prefix: []byte("page:")}))
+
+	// Expired keys are skipped and do not count against Limit
+	_, err := store.SetWithTTL([]byte("posts"), []byte("user:1:a"), []byte("value user:1:a"), time.Second)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		exists, err := store.KeyExist([]byte("posts"), []byte("user:1:a"))
+		return err == nil && !exists
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, []string{"user:10:a", "user:1:b"}, keys(storage.ScanOptions{Prefix: []byte("user:1"), Limit: 2}))
+
+	_, err = store.Scan([]byte("unknown"), storage.ScanOptions{})
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+// fillMany writes n items in one MSet, enough to cross an iterator batch
+func fillMany(t *testing.T, store interfaces.Storage, bucketName string, n int) {
+	t.Helper()
+
+	items := make(map[string][]byte, n)
+	for i := 1; i <= n; i++ {
+		items[fmt.Sprintf("key%05d", i)] = []byte(fmt.Sprintf("value%05d", i))
+	}
+
+	require.NoError(t, store.MSet([]byte(bucketName), items))
+}
+
+func testIterator(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	n := storage.IteratorBatch + 200
+	fillMany(t, store, "posts", n)
+
+	it, err := store.Iterator([]byte("posts"), storage.ScanOptions{})
+	require.NoError(t, err)
+
+	count := 0
+	for it.Next() {
+		count++
+		assert.Equal(t, fmt.Sprintf("key%05d", count), string(it.Key()))
+		assert.Equal(t, fmt.Sprintf("value%05d", count), string(it.Value()))
+	}
+
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	assert.Equal(t, n, count)
+
+	// Reversed past a batch, stopping at Limit
+	it, err = store.Iterator([]byte("posts"), storage.ScanOptions{Prefix: []byte("key"), Reverse: true, Limit: storage.IteratorBatch + 1})
+	require.NoError(t, err)
+
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+
+	require.NoError(t, it.Err())
+	assert.Equal(t, storage.IteratorBatch+1, len(keys))
+	assert.Equal(t, fmt.Sprintf("key%05d", n), keys[0])
+	assert.Equal(t, fmt.Sprintf("key%05d", n-storage.IteratorBatch), keys[len(keys)-1])
+
+	// Close stops it
+	it, err = store.Iterator([]byte("posts"), storage.ScanOptions{})
+	require.NoError(t, err)
+	assert.True(t, it.Next())
+	require.NoError(t, it.Close())
+	assert.False(t, it.Next())
+
+	_, err = store.Iterator([]byte("unknown"), storage.ScanOptions{})
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testForEach(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 5)
+
+	keys := []string{}
+	err := store.ForEach([]byte("posts"), func(k, v []byte) error {
+		keys = append(keys, string(k))
+		if len(keys) == 3 {
+			return storage.ErrStop
+		}
+
+		return nil
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{string(key(1)), string(key(2)), string(key(3))}, keys)
+
+	// fn can use the store, no transaction is open
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		return store.Delete([]byte("posts"), k)
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, 0, store.StatsBucket([]byte("posts")))
+
+	fill(t, store, "posts", 1)
+	failed := errors.New("failed")
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		return failed
+	})
+
+	assert.Equal(t, failed, err)
+
+	err = store.ForEach([]byte("unknown"), func(k, v []byte) error { return nil })
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testDelete(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 3)
+
+	require.NoError(t, store.Delete([]byte("posts"), key(2)))
+
+	v, err := store.Get([]byte("posts"), key(2))
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	items, err := store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key01", "key03"}, keysOf(t, items))
+
+	// Deleting a missing key is not an error
+	assert.NoError(t, store.Delete([]byte("posts"), []byte("missing")))
+
+	assertIs(t, store.Delete([]byte("posts"), nil), storage.ErrEmptyKey)
+	assertIs(t, store.Delete([]byte("unknown"), key(1)), storage.ErrUnknownBucket)
+}
+
+func testTTL(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 3)
+
+	_, err := store.SetWithTTL([]byte("posts"), key(1), value(1), time.Second)
+	require.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), key(2), value(2), time.Hour)
+	require.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("options"), key(1), value(1), time.Second)
+	require.NoError(t, err)
+
+	ttl, err := store.TTL([]byte("posts"), key(2))
+	require.NoError(t, err)
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour+time.Second, ttl)
+
+	// No expiry
+	ttl, err = store.TTL([]byte("posts"), key(3))
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	_, err = store.TTL([]byte("posts"), []byte("missing"))
+	assertIs(t, err, storage.ErrNotFound)
+
+	_, err = store.SetWithTTL([]byte("unknown"), key(1), value(1), time.Second)
+	assertIs(t, err, storage.ErrUnknownBucket)
+
+	// Set clears the ttl
+	_, err = store.Set([]byte("posts"), key(2), value(2))
+	require.NoError(t, err)
+
+	ttl, err = store.TTL([]byte("posts"), key(2))
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	v, err := store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+
+	// Backends may round expiry up to the next second
+	assert.Eventually(t, func() bool {
+		v, err := store.Get([]byte("posts"), key(1))
+		return err == nil && len(v) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	v, err = store.Get([]byte("options"), key(1))
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	exists, err := store.KeyExist([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = store.TTL([]byte("posts"), key(1))
+	assertIs(t, err, storage.ErrNotFound)
+
+	items, err := store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key02", "key03"}, keysOf(t, items))
+
+	items, err = store.PrevList([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key03", "key02"}, keysOf(t, items))
+
+	// Writing an expired key again brings it back without expiry
+	_, err = store.Set([]byte("posts"), key(1), value(1))
+	require.NoError(t, err)
+
+	v, err = store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+}
+
+func testMSet(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	items := map[string][]byte{}
+	for i := 1; i <= 5; i++ {
+		items[string(key(i))] = value(i)
+	}
+	require.NoError(t, store.MSet([]byte("posts"), items))
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key01", "key02", "key03", "key04", "key05"}, keysOf(t, list))
+
+	v, err := store.Get([]byte("posts"), key(3))
+	require.NoError(t, err)
+	assert.Equal(t, value(3), v)
+
+	// New keys land between the existing ones, rewritten keys are counted once
+	require.NoError(t, store.MSet([]byte("posts"), map[string][]byte{"key00": value(0), "key025": value(25), "key03": value(33), "key09": value(9)}))
+
+	list, err = store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key00", "key01", "key02", "key025", "key03", "key04", "key05", "key09"}, keysOf(t, list))
+	assert.Equal(t, 8, store.StatsBucket([]byte("posts")))
+
+	// Invalid items are rejected before anything is written
+	err = store.MSet([]byte("pages"), map[string][]byte{"key01": value(1), "key02": nil})
+	assertIs(t, err, storage.ErrEmptyValue)
+	assert.Equal(t, 0, store.StatsBucket([]byte("pages")))
+
+	err = store.MSet([]byte("pages"), map[string][]byte{"": value(1)})
+	assertIs(t, err, storage.ErrEmptyKey)
+
+	err = store.MSet([]byte("unknown"), items)
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testBulkLoader(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	loader, err := store.BulkLoader([]byte("posts"), 3)
+	require.NoError(t, err)
+
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, loader.Add(key(i), value(i)))
+	}
+
+	// Full groups are already committed
+	assert.Equal(t, 9, store.StatsBucket([]byte("posts")))
+
+	require.NoError(t, loader.Close())
+	assert.Equal(t, 10, store.StatsBucket([]byte("posts")))
+
+	v, err := store.Get([]byte("posts"), key(10))
+	require.NoError(t, err)
+	assert.Equal(t, value(10), v)
+
+	assert.Error(t, loader.Add(key(11), value(11)))
+
+	loader, err = store.BulkLoader([]byte("posts"), 3)
+	require.NoError(t, err)
+	assertIs(t, loader.Add(nil, value(1)), storage.ErrEmptyKey)
+	assertIs(t, loader.Add(key(1), nil), storage.ErrEmptyValue)
+
+	_, err = store.BulkLoader([]byte("unknown"), 3)
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testBulkLoaderConcurrent(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	const writers, perWriter = 4, 50
+
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			loader, err := store.BulkLoader([]byte("posts"), 7)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for i := 0; i < perWriter; i++ {
+				err = loader.Add([]byte(fmt.Sprintf("key%d-%03d", w, i)), value(i))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+
+			errs <- loader.Close()
+		}(w)
+	}
+
+	for w := 0; w < writers; w++ {
+		require.NoError(t, <-errs)
+	}
+
+	assert.Equal(t, writers*perWriter, store.StatsBucket([]byte("posts")))
+}
+
+func testUpdate(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "pages", 1)
+
+	err := store.Update(func(tx interfaces.Tx) error {
+		_, err := tx.Set([]byte("posts"), key(1), value(1))
+		if err != nil {
+			return err
+		}
+
+		// Reads see the transaction's own writes
+		v, err := tx.Get([]byte("posts"), key(1))
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, value(1), v)
+
+		_, err = tx.Set([]byte("options"), key(1), value(1))
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete([]byte("pages"), key(1))
+	})
+	require.NoError(t, err)
+
+	v, err := store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+
+	v, err = store.Get([]byte("options"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+
+	exists, err := store.KeyExist([]byte("pages"), key(1))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	items, err := store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key01"}, keysOf(t, items))
+
+	err = store.Update(func(tx interfaces.Tx) error {
+		_, err := tx.Set([]byte("unknown"), key(1), value(1))
+		return err
+	})
+	assertIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.Update(func(tx interfaces.Tx) error {
+		return tx.Delete([]byte("posts"), nil)
+	})
+	assertIs(t, err, storage.ErrEmptyKey)
+}
+
+func testUpdateRollback(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 2)
+
+	failure := errors.New("failure")
+	err := store.Update(func(tx interfaces.Tx) error {
+		_, err := tx.Set([]byte("posts"), key(1), []byte("changed"))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Set([]byte("pages"), key(1), value(1))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete([]byte("posts"), key(2))
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+	assertIs(t, err, failure)
+
+	// Nothing was applied
+	v, err := store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+
+	v, err = store.Get([]byte("posts"), key(2))
+	require.NoError(t, err)
+	assert.Equal(t, value(2), v)
+
+	exists, err := store.KeyExist([]byte("pages"), key(1))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Equal(t, 0, store.StatsBucket([]byte("pages")))
+}
+
+func testView(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 1)
+
+	err := store.View(func(tx interfaces.Tx) error {
+		v, err := tx.Get([]byte("posts"), key(1))
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, value(1), v)
+
+		_, err = tx.Set([]byte("posts"), key(2), value(2))
+		assertIs(t, err, storage.ErrReadOnly)
+
+		assertIs(t, tx.Delete([]byte("posts"), key(1)), storage.ErrReadOnly)
+
+		_, err = tx.Get([]byte("unknown"), key(1))
+		assertIs(t, err, storage.ErrUnknownBucket)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	exists, err := store.KeyExist([]byte("posts"), key(2))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func testCursor(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 5)
+
+	err := store.Update(func(tx interfaces.Tx) error {
+		_, err := tx.Set([]byte("posts"), key(6), value(6))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete([]byte("posts"), key(2))
+		if err != nil {
+			return err
+		}
+
+		c, err := tx.Cursor([]byte("posts"))
+		if err != nil {
+			return err
+		}
+
+		keys := []string{}
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			v2, err := tx.Get([]byte("posts"), k)
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, v2, v)
+
+			keys = append(keys, string(k))
+		}
+		assert.Equal(t, []string{"key01", "key03", "key04", "key05", "key06"}, keys)
+
+		k, _ := c.Seek([]byte("key025"))
+		assert.Equal(t, key(3), k)
+
+		k, _ = c.Prev()
+		assert.Equal(t, key(1), k)
+
+		k, v := c.Last()
+		assert.Equal(t, key(6), k)
+		assert.Equal(t, value(6), v)
+
+		k, _ = c.Next()
+		assert.Nil(t, k)
+
+		_, err = tx.Cursor([]byte("unknown"))
+		assertIs(t, err, storage.ErrUnknownBucket)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func testKeyExist(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 1)
+
+	exists, err := store.KeyExist([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.KeyExist([]byte("posts"), []byte("missing"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = store.KeyExist([]byte("unknown"), key(1))
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testValueExist(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 3)
+
+	exists, err := store.ValueExist([]byte("posts"), value(2))
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.ValueExist([]byte("posts"), []byte("missing"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = store.ValueExist([]byte("unknown"), value(1))
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testKeysByValue(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 3)
+
+	_, err := store.Set([]byte("posts"), key(3), value(1))
+	require.NoError(t, err)
+
+	keys, err := store.KeysByValue([]byte("posts"), value(1))
+	require.NoError(t, err)
+	assert.Equal(t, []string{string(key(1)), string(key(3))}, keys)
+
+	require.NoError(t, store.Delete([]byte("posts"), key(1)))
+
+	keys, err = store.KeysByValue([]byte("posts"), value(1))
+	require.NoError(t, err)
+	assert.Equal(t, []string{string(key(3))}, keys)
+
+	keys, err = store.KeysByValue([]byte("posts"), []byte("missing"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, keys)
+
+	_, err = store.KeysByValue([]byte("unknown"), value(1))
+	assertIs(t, err, storage.ErrUnknownBucket)
+}
+
+func testBuckets(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 4)
+
+	for _, bucketName := range append(Buckets, Indexes...) {
+		assert.True(t, store.HasBucket([]byte(bucketName)), bucketName)
+	}
+
+	assert.False(t, store.HasBucket([]byte("unknown")))
+	assert.False(t, store.HasBucket(nil))
+
+	assert.Equal(t, 4, store.StatsBucket([]byte("posts")))
+	assert.Equal(t, 0, store.StatsBucket([]byte("pages")))
+	assert.Equal(t, 0, store.StatsBucket([]byte("unknown")))
+}
+
+func testCreateBucket(t *testing.T, open Factory) {
+	path := dir(t)
+
+	store, err := open(Buckets, Indexes, path, dbName, false)
+	require.NoError(t, err)
+
+	require.NoError(t, store.CreateBucket([]byte("tenants")))
+	require.NoError(t, store.CreateIndex([]byte("tenant-posts")))
+	require.NoError(t, store.CreateBucket([]byte("tenants")), "creating it again does nothing")
+
+	assertIs(t, store.CreateBucket(nil), storage.ErrInvalidBucket)
+	assertIs(t, store.CreateIndex([]byte("[ttl]")), storage.ErrInvalidBucket)
+
+	fill(t, store, "tenants", 2)
+	fill(t, store, "tenant-posts", 3)
+	require.NoError(t, store.CloseStore())
+
+	// Reopened without the created names
+	store, err = open(nil, nil, path, dbName, false)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = store.CloseStore()
+	})
+
+	for _, bucketName := range append(Buckets, "tenants", "tenant-posts") {
+		assert.True(t, store.HasBucket([]byte(bucketName)), bucketName)
+	}
+
+	v, err := store.Get([]byte("tenants"), key(2))
+	require.NoError(t, err)
+	assert.Equal(t, value(2), v)
+
+	items, err := store.List([]byte("tenant-posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key01", "key02", "key03"}, keysOf(t, items))
+}
+
+func testListBucket(t *testing.T, open Factory) {
+	store := openStore(t, open)
+
+	buckets, err := store.ListBucket()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, Buckets, buckets)
+
+	// Created buckets are listed, indexes are not
+	require.NoError(t, store.CreateBucket([]byte("tenants")))
+	require.NoError(t, store.CreateIndex([]byte("tenant-posts")))
+
+	buckets, err = store.ListBucket()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, append(Buckets, "tenants"), buckets)
+}
+
+func testDeleteBucket(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 3)
+	fill(t, store, "pages", 2)
+
+	require.NoError(t, store.DeleteBucket([]byte("posts")))
+
+	assert.Equal(t, 0, store.StatsBucket([]byte("posts")))
+	assert.Equal(t, 2, store.StatsBucket([]byte("pages")))
+
+	v, err := store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	items, err := store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	// The bucket is still usable after being emptied
+	_, err = store.Set([]byte("posts"), key(1), value(1))
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.StatsBucket([]byte("posts")))
+
+	assertIs(t, store.DeleteBucket([]byte("unknown")), storage.ErrUnknownBucket)
+}
+
+func testReadOnly(t *testing.T, open Factory) {
+	path := dir(t)
+
+	store, err := open(Buckets, Indexes, path, dbName, false)
+	require.NoError(t, err)
+	fill(t, store, "posts", 2)
+	require.NoError(t, store.CloseStore())
+
+	store = openStoreAt(t, open, path, true)
+
+	v, err := store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+
+	items, err := store.List([]byte("posts"), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key01", "key02"}, keysOf(t, items))
+
+	_, err = store.Set([]byte("posts"), key(3), value(3))
+	assertIs(t, err, storage.ErrReadOnly)
+
+	assertIs(t, store.Delete([]byte("posts"), key(1)), storage.ErrReadOnly)
+	assertIs(t, store.DeleteBucket([]byte("posts")), storage.ErrReadOnly)
+
+	v, err = store.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+}
+
+func testBackupRestore(t *testing.T, open Factory) {
+	backupPath := dir(t)
+
+	store := openStore(t, open)
+	fill(t, store, "posts", 5)
+	fill(t, store, "options", 1)
+	require.NoError(t, store.Backup(backupPath, "snapshot"))
+
+	restored := openStore(t, open)
+	require.NoError(t, restored.Restore(backupPath, "snapshot"))
+
+	for i := 1; i <= 5; i++ {
+		v, err := restored.Get([]byte("posts"), key(i))
+		require.NoError(t, err)
+		assert.Equal(t, value(i), v)
+	}
+
+	v, err := restored.Get([]byte("options"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+}
+
+func testBackupToRestoreFrom(t *testing.T, open Factory) {
+	store := openStore(t, open)
+	fill(t, store, "posts", 5)
+	fill(t, store, "options", 1)
+
+	var archive bytes.Buffer
+	require.NoError(t, store.BackupTo(&archive))
+
+	restored := openStore(t, open)
+	_, err := restored.Set([]byte("posts"), key(9), value(9))
+	require.NoError(t, err)
+	require.NoError(t, restored.RestoreFrom(&archive))
+
+	for i := 1; i <= 5; i++ {
+		v, err := restored.Get([]byte("posts"), key(i))
+		require.NoError(t, err)
+		assert.Equal(t, value(i), v)
+	}
+
+	v, err := restored.Get([]byte("options"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+
+	exists, err := restored.KeyExist([]byte("posts"), key(9))
+	require.NoError(t, err)
+	assert.False(t, exists, "keys written before the restore are gone")
+
+	// Anything that is not an archive is rejected and the store is kept
+	assert.Error(t, restored.RestoreFrom(strings.NewReader("not an archive")))
+
+	v, err = restored.Get([]byte("posts"), key(1))
+	require.NoError(t, err)
+	assert.Equal(t, value(1), v)
+}
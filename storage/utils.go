@@ -2,7 +2,11 @@ package storage
 
 import (
 	"encoding/binary"
+	"io"
 	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 // u64tob converts a uint64 into an 8-byte slice.
@@ -53,3 +57,49 @@ func DeleteFileOrDirectory(path string) error {
 
 	return nil
 }
+
+// Usage: copy a backup file next to the db before swapping it in
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Usage: open a boltdb backup file read-only and run bolt's consistency check on it
+func CheckBoltFile(file string) error {
+	db, err := bolt.Open(file, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		// Drain the channel, the check goroutine reads pages until it is done
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+
+		return first
+	})
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ValuesBucket is the bolt root bucket of the value indexes, opt-in per bucket. It holds a nested bucket per
+// indexed bucket with two buckets of its own: hashes (sha256 of the value + key -> nothing) and keys (key -> sha256).
+var ValuesBucket = []byte("[values]")
+
+var (
+	valueHashes = []byte("hashes")
+	valueKeys   = []byte("keys")
+)
+
+// HasValueIndex reports whether bucketName has a value index in t
+func HasValueIndex(t *bolt.Tx, bucketName []byte) bool {
+	root := t.Bucket(ValuesBucket)
+	return root != nil && root.Bucket(bucketName) != nil
+}
+
+// CreateValueIndex adds an empty value index for bucketName to t, an existing one is kept
+func CreateValueIndex(t *bolt.Tx, bucketName []byte) error {
+	root, err := t.CreateBucketIfNotExists(ValuesBucket)
+	if err != nil {
+		return err
+	}
+
+	b, err := root.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.CreateBucketIfNotExists(valueHashes)
+	if err == nil {
+		_, err = b.CreateBucketIfNotExists(valueKeys)
+	}
+
+	return err
+}
+
+// DropValueIndex removes the value index of bucketName from t
+func DropValueIndex(t *bolt.Tx, bucketName []byte) error {
+	if !HasValueIndex(t, bucketName) {
+		return nil
+	}
+
+	return t.Bucket(ValuesBucket).DeleteBucket(bucketName)
+}
+
+// ValueIndexes returns the names of the buckets with a value index in t
+func ValueIndexes(t *bolt.Tx) []string {
+	names := []string{}
+
+	root := t.Bucket(ValuesBucket)
+	if root == nil {
+		return names
+	}
+
+	_ = root.ForEach(func(name, _ []byte) error {
+		names = append(names, string(name))
+		return nil
+	})
+
+	return names
+}
+
+// SetValue records that k of bucketName holds v, replacing its previous value. Buckets without value index are skipped.
+func SetValue(t *bolt.Tx, bucketName []byte, k []byte, v []byte) error {
+	if !HasValueIndex(t, bucketName) {
+		return nil
+	}
+
+	err := DeleteValue(t, bucketName, k)
+	if err != nil {
+		return err
+	}
+
+	b := t.Bucket(ValuesBucket).Bucket(bucketName)
+	sum := sha256.Sum256(v)
+
+	err = b.Bucket(valueHashes).Put(valueKey(sum[:], k), []byte{})
+	if err != nil {
+		return err
+	}
+
+	return b.Bucket(valueKeys).Put(k, sum[:])
+}
+
+// DeleteValue drops k of bucketName from its value index. Buckets without value index are skipped.
+func DeleteValue(t *bolt.Tx, bucketName []byte, k []byte) error {
+	if !HasValueIndex(t, bucketName) {
+		return nil
+	}
+
+	b := t.Bucket(ValuesBucket).Bucket(bucketName)
+
+	sum := b.Bucket(valueKeys).Get(k)
+	if sum == nil {
+		return nil
+	}
+
+	err := b.Bucket(valueHashes).Delete(valueKey(sum, k))
+	if err != nil {
+		return err
+	}
+
+	return b.Bucket(valueKeys).Delete(k)
+}
+
+// ValueKeys returns the keys of bucketName whose value hashes like v, sorted. Callers compare the values,
+// hashes may collide.
+func ValueKeys(t *bolt.Tx, bucketName []byte, v []byte) [][]byte {
+	keys := [][]byte{}
+	if !HasValueIndex(t, bucketName) {
+		return keys
+	}
+
+	sum := sha256.Sum256(v)
+	c := t.Bucket(ValuesBucket).Bucket(bucketName).Bucket(valueHashes).Cursor()
+
+	for key, _ := c.Seek(sum[:]); key != nil && bytes.HasPrefix(key, sum[:]); key, _ = c.Next() {
+		keys = append(keys, append([]byte{}, key[len(sum):]...))
+	}
+
+	return keys
+}
+
+func valueKey(sum []byte, k []byte) []byte {
+	key := make([]byte, 0, len(sum)+len(k))
+	key = append(key, sum...)
+
+	return append(key, k...)
+}